@@ -0,0 +1,37 @@
+class TeleDLError(Exception):
+    exit_code = 1
+
+
+# The page could not be fetched or the API answered with something unusable
+class PageError(TeleDLError):
+    exit_code = 1
+
+
+# The link is not a telegra.ph page
+class InvalidURLError(PageError):
+    exit_code = 2
+
+
+# The API answered ok: false, e.g. PAGE_NOT_FOUND
+class PageNotFoundError(PageError):
+    exit_code = 5
+
+
+# The page cannot be saved into its output folder
+class OutputError(PageError):
+    exit_code = 1
+
+
+# The page has no media (only raised with --fail-if-empty)
+class NoMediaError(TeleDLError):
+    exit_code = 3
+
+
+# Some downloads of the page failed
+class PartialFailureError(TeleDLError):
+    exit_code = 4
+
+
+# The page has media nodes that could not be read (only with --parser-mode strict)
+class StructureError(TeleDLError):
+    exit_code = 6
@@ -1,85 +1,1174 @@
 import asyncio
+import functools
+import glob
+import hashlib
+import http.server
+import mimetypes
+import netrc
+import os
 import pathlib
+import random
+import re
+import shutil
+import signal
+import socket
+import sys
+import tempfile
+import time
+import traceback
+import uuid
+from collections import Counter, deque
+from fnmatch import fnmatch
+from urllib.parse import urlsplit, quote
 
 import ujson
-from datetime import datetime
-from utils import getsize, convert_bytes, arguments
+from datetime import datetime, timedelta
+from utils import getsize, convert_bytes, arguments, expand_folder, sanitize_filename, Retry, \
+    media_url, media_name, sha256sum, load_netrc, looks_like_html, \
+    sniff_type, sniffed_name, strip_metadata, thumbnail, contact_sheet, Image, extract_media, render_index, \
+    gallery_entries, render_mirror, render_tree, parse_selection, limit_depth, unique_path, file_names, \
+    media_category, MEDIA_CATEGORIES, MEDIA_SOURCES, MAX_DEPTH, page_path, TELEGRAPH_HOSTS, long_path, convert_image, \
+    AsciiOutput, stage_folder, commit_folder, ByteBudget, Breaker, refresh_target, group_by_extension
+from errors import PageError, PageNotFoundError, OutputError, NoMediaError, PartialFailureError, StructureError
 
 import aiofiles
 import aiohttp
+from aiohttp.abc import AbstractResolver
+from aiohttp.resolver import DefaultResolver
 
 
-async def download_file(_url, folder, file_id=None):
-    if not pathlib.Path(f"{folder}/{file_id}_{_url}").exists() or getsize(f"{folder}/{file_id}_{_url}")['raw'] == 0:
+SHOW_FILES_LIMIT = 20
+TELEGRAPH_RATE = 10
+TOOL_FILES = ('index.html', 'order.txt')
+REFRESH_PAGE_LIMIT = 64 * 1024
+REFRESH_HOPS = 5
+
+
+class PinnedResolver(AbstractResolver):
+    def __init__(self, addresses):
+        self.addresses = addresses
+        self.resolver = DefaultResolver()
+
+    async def resolve(self, host, port=0, family=socket.AF_INET):
+        if (address := self.addresses.get(host.lower())) is None:
+            return await self.resolver.resolve(host, port, family)
+        return [{'hostname': host, 'host': address, 'port': port,
+                 'family': socket.AF_INET6 if ':' in address else socket.AF_INET,
+                 'proto': 0, 'flags': socket.AI_NUMERICHOST}]
+
+    async def close(self):
+        await self.resolver.close()
+
+
+class NotMediaError(Exception):
+    pass
+
+
+class TooLargeError(Exception):
+    pass
+
+
+class KnownContentError(Exception):
+    pass
+
+
+def request_headers(_url, link, item=None):
+    args = parser.parse_args()
+    headers = {'X-Request-Id': run_id if item is None else f"{run_id}-{item}"}
+    host = urlsplit(_url).hostname
+    if credentials and host in credentials.hosts:
+        login, _, password = credentials.hosts[host]
+        headers['Authorization'] = aiohttp.BasicAuth(login, password or '').encode()
+    if host in (args.auth_host or []):
+        if args.basic_auth:
+            login, _, password = args.basic_auth.partition(':')
+            headers['Authorization'] = aiohttp.BasicAuth(login, password).encode()
+        if args.bearer_token:
+            headers['Authorization'] = f"Bearer {args.bearer_token}"
+    if args.referer_auto:
+        headers['Referer'] = link if host == urlsplit(link).hostname else f"{urlsplit(_url).scheme}://{host}/"
+    return headers
+
+
+async def read_limited(response, limit):
+    body = bytearray()
+    async for chunk in response.content.iter_chunked(64 * 1024):
+        body += chunk
+        if len(body) > limit:
+            raise TooLargeError(f"more than the {limit.text} limit")
+    return bytes(body)
+
+
+async def fetch_file(session, link, _url, folder, filename, file_id=None, hops=0):
+    path = None
+    async with session.get(_url, headers=request_headers(_url, link, file_id)) as response:
+        if response.status == 200:
+            limit = parser.parse_args().max_size_by_ext.get(pathlib.PurePath(filename).suffix.lower())
+            if limit is not None and (response.content_length or 0) > limit:
+                raise TooLargeError(f"{size_text(response.content_length)} is over the "
+                                    f"{limit.text} limit for {pathlib.PurePath(filename).suffix}")
+            body = await response.read() if limit is None else await read_limited(response, limit)
+            if parser.parse_args().follow_meta_refresh and len(body) <= REFRESH_PAGE_LIMIT \
+                    and looks_like_html(response.content_type, body) \
+                    and (target := refresh_target(body, str(response.url))):
+                if hops >= REFRESH_HOPS:
+                    raise NotMediaError(f"more than {REFRESH_HOPS} meta refresh redirects")
+                print(f"~> {filename} — redirected to {target}") if parser.parse_args().explicit else None
+                if suffix := pathlib.PurePosixPath(media_name(target)).suffix:
+                    filename = sanitize_filename(f"{pathlib.PurePath(filename).stem}{suffix}")
+                return await fetch_file(session, link, target, folder, filename, file_id, hops + 1)
+            if parser.parse_args().strict_content_type and looks_like_html(response.content_type, body):
+                raise NotMediaError(f"expected media but got an HTML page ({response.content_type})")
+            if parser.parse_args().strip_metadata:
+                stripped = strip_metadata(body)
+                stats['metadata_bytes'] += len(body) - len(stripped)
+                body = stripped
+            if parser.parse_args().only_new:
+                digest = hashlib.sha256(body).hexdigest()
+                if digest in known_content:
+                    raise KnownContentError(f"same content as {known_content[digest]}")
+                known_content[digest] = filename
+            if parser.parse_args().fix_extensions and (sniffed := sniff_type(body)):
+                mime, extension = sniffed
+                if mime not in (mimetypes.guess_type(filename)[0], response.content_type):
+                    renamed = sniffed_name(filename, extension, page_names)
+                    page_names.add(renamed)
+                    print(f"~> {filename} is {mime}, saving as {renamed}") if parser.parse_args().explicit else None
+                    filename = renamed
+
+            if parser.parse_args().organize_by_type:
+                mime = sniffed[0] if (sniffed := sniff_type(body)) else response.content_type
+                if mime == 'application/octet-stream':
+                    mime = mimetypes.guess_type(filename)[0]
+                folder = pathlib.Path(folder).joinpath(media_category(mime))
+
+            if not pathlib.Path(folder).exists():
+                try:
+                    long_path(folder).mkdir(parents=True, exist_ok=True)
+                except OSError as error:
+                    raise OutputError(f"could not create the directory {folder}: {error}")
+                print(
+                    f"~> Successfully created the directory {folder}"
+                ) if parser.parse_args().explicit else None
+
+            path = pathlib.Path().joinpath(f"{folder}/{filename}")
+            if parser.parse_args().no_skip:
+                path = unique_path(path, twin(path.parent))
+            try:
+                long_path(path).unlink(missing_ok=True)
+                partial_files.add(path)
+                async with aiofiles.open(long_path(path), 'wb+') as file:
+                    await file.write(body)
+                    print(
+                        f"~> {filename} — {size_text(getsize(long_path(path))['raw'])}"
+                    ) if parser.parse_args().explicit else None
+                    await file.flush()
+            except OSError as error:
+                raise OutputError(f"could not write {path}: {error}")
+            partial_files.discard(path)
+        return response.status, path
+
+
+async def remote_info(session, link, _url):
+    try:
+        async with session.head(_url, headers=request_headers(_url, link), allow_redirects=True) as response:
+            if response.status == 200:
+                return {'url': _url, 'type': response.content_type, 'size': response.content_length}
+    except aiohttp.ClientError:
+        pass
+    return {'url': _url, 'type': None, 'size': None}
+
+
+async def remote_size(session, link, _url):
+    host = urlsplit(_url).hostname
+    if breakers.tripped(host):
+        return None
+    async with host_semaphore(host), semaphore:
+        await pace_host(host)
+        return (await remote_info(session, link, _url))['size']
+
+
+async def check_url(session, link, _url):
+    args = parser.parse_args()
+    host = urlsplit(_url).hostname
+    result = {'url': _url, 'status': None, 'reachable': False, 'error': None}
+    async with host_semaphore(host), semaphore:
+        retry = Retry(args.retries, args.retry_base_delay, args.retry_max_delay, args.retry_strategy, spend_retry)
+        async for _ in retry:
+            await pace_host(host)
+            try:
+                async with session.head(_url, headers=request_headers(_url, link), allow_redirects=True) as response:
+                    result['status'] = response.status
+                if result['status'] in (403, 405, 501):
+                    headers = {**request_headers(_url, link), 'Range': 'bytes=0-0'}
+                    async with session.get(_url, headers=headers, allow_redirects=True) as response:
+                        result['status'] = response.status
+            except aiohttp.ClientError as error:
+                result['error'] = f"{type(error).__name__}: {error}"
+                continue
+            result['error'] = None
+            if result['status'] < 500:
+                break
+    result['reachable'] = result['status'] in (200, 206)
+    return result
+
+
+def twin(path):
+    for staging, target in staged_targets.items():
+        if path == staging or staging in path.parents:
+            return target.joinpath(path.relative_to(staging))
+    return None
+
+
+def already_saved(folder, filename):
+    folders = [pathlib.Path(folder)]
+    if parser.parse_args().organize_by_type:
+        folders.extend(pathlib.Path(folder).joinpath(category) for category in (*MEDIA_CATEGORIES.values(), 'other'))
+    names = [filename] + [f"{pathlib.PurePath(filename).stem}.{target}"
+                          for source, target in parser.parse_args().convert or []
+                          if pathlib.PurePath(filename).suffix.lower() == f".{source}"]
+    candidates = [directory.joinpath(name) for directory in folders for name in names]
+    if parser.parse_args().fix_extensions:
+        stem = glob.escape(pathlib.PurePath(filename).stem)
+        for directory in folders:
+            candidates.extend(path for pattern in (f"{stem}.*", f"{stem}_*.*") for path in directory.glob(pattern)
+                              if (extension := sniffed_extension(path))
+                              and path.name == sniffed_name(filename, extension, page_names))
+    return next((path for path in candidates if path.is_file() and path.stat().st_size > 0), None)
+
+
+def sniffed_extension(path):
+    try:
+        with open(long_path(path), 'rb') as file:
+            sniffed = sniff_type(file.read(16))
+    except OSError:
+        return None
+    return sniffed[1] if sniffed else None
+
+
+def host_semaphore(host):
+    if host not in host_semaphores:
+        limit = next((limit for pattern, limit in parser.parse_args().host_workers if fnmatch(host, pattern)),
+                     parser.parse_args().workers)
+        host_semaphores[host] = asyncio.Semaphore(limit)
+    return host_semaphores[host]
+
+
+def spend_retry():
+    if parser.parse_args().max_retries_total is not None and stats['retries'] >= parser.parse_args().max_retries_total:
+        return False
+    stats['retries'] += 1
+    return True
+
+
+async def pace_host(host):
+    limit = parser.parse_args().host_rate
+    if limit is None:
+        limit = TELEGRAPH_RATE if host in TELEGRAPH_HOSTS else 0
+    if not limit:
+        return
+
+    window = host_windows.setdefault(host, deque())
+    while True:
+        now = time.monotonic()
+        while window and now - window[0] >= 1:
+            window.popleft()
+        if len(window) < limit:
+            window.append(now)
+            return
+        await asyncio.sleep(1 - (now - window[0]))
+
+
+async def download_file(session, link, _url, folder, filename, file_id=None):
+    existing = None if parser.parse_args().no_skip else already_saved(twin(folder) or folder, filename)
+    result = {'id': file_id, 'url': _url, 'name': filename, 'file': existing, 'status': 'skipped', 'error': None}
+    if result['file'] and result['file'].name == filename and parser.parse_args().verify_existing \
+            and not parser.parse_args().strip_metadata:
+        expected = await remote_size(session, link, _url)
+        size = result['file'].stat().st_size
+        if expected is not None and expected != size:
+            print(
+                f"~> {result['file'].name} — has {size} of {expected} bytes, downloading again"
+            ) if parser.parse_args().explicit else None
+            result['file'] = None
+
+    if result['file'] is None and (parser.parse_args().small_file_threshold is not None
+                                   or parser.parse_args().max_inflight_bytes):
+        result['size'] = await remote_size(session, link, _url)
+    if result['file'] is None and parser.parse_args().small_file_threshold is not None:
+        small = result['size'] is not None and result['size'] < parser.parse_args().small_file_threshold
+        result['tier'] = 'small' if small else 'large'
+        print(f"~> {filename} — {result['tier']} file") if parser.parse_args().explicit else None
+
+    if result['file'] is None:
+        result['status'] = 'failed'
+        host = urlsplit(_url).hostname
+        async with tier_semaphores[result.get('tier') or 'small'], inflight.reserve(result.get('size') or 0), \
+                host_semaphore(host), semaphore:
+            args = parser.parse_args()
+            if args.ramp_up and stats['started'] < args.workers:
+                stats['started'] += 1
+                await asyncio.sleep(args.ramp_up * (stats['started'] - 1) / args.workers)
+            retry = Retry(args.retries, args.retry_base_delay, args.retry_max_delay, args.retry_strategy, spend_retry)
+            async for attempt in retry:
+                if breakers.tripped(host):
+                    print(f"~> {filename} — skipped, too many failures from {host}") if args.explicit else None
+                    result['status'] = 'blocked'
+                    result['error'] = f"too many failures from {host}"
+                    break
+                try:
+                    await running.wait()
+                    await pace_host(host)
+                    status, result['file'] = await fetch_file(session, link, _url, folder, filename, file_id)
+                except NotMediaError as error:
+                    print(f"~> {filename} — {error}")
+                    result['error'] = str(error)
+                    break
+                except KnownContentError as error:
+                    print(f"~> {filename} — skipped, {error}") if args.explicit else None
+                    result['status'] = 'known'
+                    break
+                except TooLargeError as error:
+                    print(f"~> {filename} — skipped, {error}")
+                    result['status'] = 'too-large'
+                    break
+                except aiohttp.ClientError as error:
+                    breakers.record(host, False)
+                    print(f"~> {filename} — attempt {attempt + 1} failed: {error}") if args.explicit else None
+                    result['error'] = f"{type(error).__name__}: {error}"
+                    continue
+
+                if status == 200:
+                    breakers.record(host, True)
+                    result['status'], result['error'] = 'downloaded', None
+                    break
+                if status == 401:
+                    print(f"~> {filename} — HTTP 401, {host} rejected the credentials")
+                    result['error'] = f"HTTP 401 from {host}"
+                    break
+                print(f"~> {filename} — attempt {attempt + 1} failed: HTTP {status}") if args.explicit else None
+                result['error'] = f"HTTP {status}"
+                if status == 404 and args.quiet_errors:
+                    result['status'], result['error'] = 'missing', None
+                if status == 404:
+                    break
+                breakers.record(host, False)
+            if retry.exhausted:
+                print(f"~> {filename} — retry budget exhausted") if args.explicit else None
+                result['error'] = f"{result['error']} (retry budget exhausted)"
+    emit('download', link=link, **{**result, 'file': str(result['file']) if result['file'] else None})
+    return result
+
+
+async def download_embed(_url, folder):
+    if urlsplit(_url).scheme not in ('http', 'https'):
+        print(f"~> Skipped embedded video {_url!r}: not an http(s) URL")
+        return False
+    async with semaphore:
+        process = await asyncio.create_subprocess_exec(
+            'yt-dlp', '--no-progress', '--paths', str(folder), '--', _url,
+            stdout=asyncio.subprocess.PIPE,
+            stderr=asyncio.subprocess.STDOUT
+        )
+        output, _ = await process.communicate()
+        print(output.decode(errors='replace').rstrip()) if parser.parse_args().explicit else None
+        return process.returncode == 0
+
+
+def tool_file(name):
+    return name in TOOL_FILES or name.startswith('thumbnails/')
+
+
+def verify_manifest(manifest, folder):
+    try:
+        lines = manifest.read_text().splitlines()
+    except OSError as error:
+        print(f"~> Could not read the manifest: {error}")
+        return 2
+
+    expected = {}
+    for number, line in enumerate(lines, 1):
+        if not line.strip():
+            continue
+        digest, _, name = line.strip().partition(' ')
+        if not re.fullmatch(r'[0-9a-fA-F]{64}', digest) or not name.strip(' *'):
+            print(f"~> {manifest}:{number}: expected a SHA-256 digest and a file name, got {line.strip()!r}")
+            return 2
+        expected[name.strip().lstrip('*')] = digest.lower()
+
+    names = (file.relative_to(folder).as_posix() for file in folder.glob('**/*')
+             if file.is_file() and file.resolve() != manifest.resolve())
+    actual = {name for name in names if name in expected or not tool_file(name)}
+    missing = sorted(expected.keys() - actual)
+    corrupt = sorted(name for name in expected.keys() & actual if sha256sum(folder.joinpath(name)) != expected[name])
+    extra = sorted(actual - expected.keys())
+
+    for label, names in (('Missing', missing), ('Corrupt', corrupt), ('Extra', extra)):
+        for name in names:
+            print(f"~> {label}: {name}")
+    print(f"~> Verified {len(expected) - len(missing) - len(corrupt)}/{len(expected)} files in {folder}")
+    return 1 if missing or corrupt or extra else 0
+
+
+def link_duplicate(original, duplicate, mode):
+    temporary = duplicate.with_name(f"{duplicate.name}.dedup")
+    if mode == 'hard':
+        try:
+            os.link(original, temporary)
+            return os.replace(temporary, duplicate)
+        except OSError as error:
+            print(f"~> Could not hardlink {duplicate.name} ({error.strerror}), using a symlink") \
+                if parser.parse_args().explicit else None
+    temporary.symlink_to(os.path.relpath(original, duplicate.parent))
+    os.replace(temporary, duplicate)
+
+
+def dedup_files(results, mode):
+    originals, saved = {}, 0
+    for result in results:
+        if not result['file'] or result['file'].is_symlink():
+            continue
+        original = originals.setdefault(sha256sum(result['file']), result['file'])
+        if original == result['file'] or os.path.samefile(original, result['file']):
+            continue
+
+        size = result['file'].stat().st_size
+        try:
+            if mode == 'delete':
+                result['file'].unlink()
+                result['file'] = original
+            else:
+                link_duplicate(original, result['file'], mode)
+        except OSError as error:
+            print(f"~> Could not replace duplicate {result['file'].name}: {error.strerror}")
+            continue
+        saved += size
+    return saved
+
+
+async def convert_files(results):
+    if Image is None:
+        print("~> Pillow is not installed, skipping conversions")
+        return
+
+    conversions = dict(parser.parse_args().convert)
+
+    async def convert(result):
         async with semaphore:
-            async with aiohttp.ClientSession(json_serialize=ujson.dumps,
-                                             headers={'Connection': 'keep-alive'}) as session:
-                async with session.get(f"https://telegra.ph/file/{_url}") as response:
-                    if response.status == 200:
-                        if not pathlib.Path(folder).exists():
-                            try:
-                                pathlib.Path(folder).mkdir(parents=True, exist_ok=True)
-                            except OSError:
-                                print(
-                                    f"~> Creation of the directory {folder} failed"
-                                ) if parser.parse_args().explicit else None
-                            else:
-                                print(
-                                    f"~> Successfully created the directory {folder}"
-                                ) if parser.parse_args().explicit else None
-
-                        path = pathlib.Path().joinpath(f"{folder}/{file_id}_{_url}")
-                        async with aiofiles.open(path, 'wb+') as file:
-                            await file.write(await response.read())
-                            print(
-                                f"~> {file_id}_{_url} — {getsize(path)['formatted']}"
-                            ) if parser.parse_args().explicit else None
-                            await file.flush()
-
-
-async def main():
-    async with aiohttp.ClientSession(json_serialize=ujson.dumps, headers={'Connection': 'keep-alive'}) as session:
-        async with session.get(
-                f"https://api.telegra.ph/getPage/{parser.parse_args().link.removeprefix('https://telegra.ph/')}",
-                params={'return_content': 'true'}
-        ) as response:
-            response = await response.json()
-
-            old_size = getsize(parser.parse_args().folder)['raw']
-            start_time = datetime.now()
-            print(f"~> Started at: {datetime.now()}",
-                  f"~> Saving: {response['result']['title']}",
-                  sep="\n")
-
-            queue = response['result']['content']
-            files = []
-
-            while queue:
-                curr = queue.pop()
-
-                if "children" in curr and (nexts := curr["children"]) and isinstance(nexts, list):
-                    queue.extend(nexts)
-
-                if isinstance(curr, dict) and (curr["tag"] == "img" or curr["tag"] == "video"):
-                    files.append(curr['attrs']['src'])
-
-            urls = [filename.split('/')[-1] for filename in files[::-1]]
-            print(f"~> Files in telegraph page: {len(urls)}") if parser.parse_args().explicit else None
-
-            await asyncio.gather(*[download_file(
+            try:
+                converted = await asyncio.to_thread(convert_image, result['file'],
+                                                    conversions[result['file'].suffix.lower().lstrip('.')])
+            except (OSError, ValueError) as error:
+                print(f"~> Could not convert {result['file'].name}: {error}")
+                return False
+        if not parser.parse_args().keep_original:
+            result['file'].unlink()
+        result['file'] = converted
+        return True
+
+    converted = await asyncio.gather(*[convert(result) for result in results if result['status'] == 'downloaded'
+                                       and result['file'].suffix.lower().lstrip('.') in conversions])
+    print(f"~> Converted: {sum(converted)}/{len(converted)}") if converted else None
+
+
+def write_thumbnails(files, folder, sheet=None):
+    if Image is None:
+        print("~> Pillow is not installed, skipping thumbnails")
+        return
+
+    size = parser.parse_args().thumbnails or (256, 256)
+    images = {file: image for file in files if (image := thumbnail(file, size))}
+    if len(images) < len(files):
+        print(
+            f"~> Could not make thumbnails for {len(files) - len(images)} files"
+        ) if parser.parse_args().explicit else None
+
+    if parser.parse_args().thumbnails:
+        folder.joinpath('thumbnails').mkdir(exist_ok=True)
+        for file, image in images.items():
+            image.save(folder.joinpath('thumbnails', f"{file.stem}.jpg"))
+        print(f"~> Thumbnails: {len(images)} in {folder.joinpath('thumbnails')}")
+
+    if sheet and images:
+        contact_sheet(list(images.values()), size).save(sheet)
+        print(f"~> Contact sheet: {sheet}")
+
+
+class GalleryHandler(http.server.SimpleHTTPRequestHandler):
+    def do_GET(self):
+        if self.path == '/' and not pathlib.Path(self.directory).joinpath('index.html').exists():
+            return self.send_gallery()
+
+        path = pathlib.Path(self.translate_path(self.path))
+        match = re.fullmatch(r'bytes=(\d*)-(\d*)', self.headers.get('Range', '').strip())
+        if not match or not any(match.groups()) or not path.is_file():
+            return super().do_GET()
+
+        size = path.stat().st_size
+        start, end = match.groups()
+        start, end = (int(start), min(int(end or size - 1), size - 1)) if start else (max(size - int(end), 0), size - 1)
+        if start > end:
+            return self.send_error(416)
+
+        self.send_response(206)
+        self.send_header('Content-Type', self.guess_type(str(path)))
+        self.send_header('Content-Range', f"bytes {start}-{end}/{size}")
+        self.send_header('Content-Length', str(end - start + 1))
+        self.send_header('Accept-Ranges', 'bytes')
+        self.end_headers()
+        with open(path, 'rb') as file:
+            file.seek(start)
+            remaining = end - start + 1
+            while remaining and (chunk := file.read(min(64 * 1024, remaining))):
+                self.wfile.write(chunk)
+                remaining -= len(chunk)
+
+    def send_gallery(self):
+        folder = pathlib.Path(self.directory)
+        body = render_index(folder.name, None, None, gallery_entries(folder)).encode()
+        self.send_response(200)
+        self.send_header('Content-Type', 'text/html; charset=utf-8')
+        self.send_header('Content-Length', str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+
+def serve(folder, port, address):
+    handler = functools.partial(GalleryHandler, directory=str(folder))
+    with http.server.ThreadingHTTPServer((address, port), handler) as server:
+        print(f"~> Serving {folder} at http://{'localhost' if address == '127.0.0.1' else address}:{port}/")
+        try:
+            server.serve_forever()
+        except KeyboardInterrupt:
+            pass
+
+
+def size_text(num):
+    return convert_bytes(num, parser.parse_args().units, parser.parse_args().size_precision)
+
+
+class Progress:
+    def __init__(self, total):
+        self.total, self.done, self.downloaded = total, 0, 0
+        self.last_time, self.last_done = time.monotonic(), 0
+
+    async def track(self, download):
+        result = await download
+        self.done += 1
+        self.downloaded += result['status'] == 'downloaded'
+
+        interval, every = parser.parse_args().progress_interval, parser.parse_args().progress_every
+        if self.done < self.total and ((interval and time.monotonic() - self.last_time >= interval)
+                                       or (every and self.done - self.last_done >= every)):
+            print(f"~> Progress: {self.done}/{self.total} done, {self.downloaded} downloaded")
+            self.last_time, self.last_done = time.monotonic(), self.done
+        return result
+
+
+def media_sources():
+    return {**MEDIA_SOURCES, **dict(parser.parse_args().source_attrs or [])}
+
+
+def emit(event, **fields):
+    if parser.parse_args().events == 'json':
+        print(ujson.dumps({'type': event, **fields}), file=event_output, flush=True)
+
+
+def colored(text, code):
+    if parser.parse_args().no_color or os.environ.get('NO_COLOR') or isinstance(sys.stdout, AsciiOutput) \
+            or not sys.stdout.isatty():
+        return text
+    return f"\033[{code}m{text}\033[0m"
+
+
+def choose_media(media, urls):
+    for number, (item, url) in enumerate(zip(media, urls), 1):
+        print(f"{number:>4}. {media_name(url)}  [{item['tag']}]  {item['alt'] or item['caption'] or ''}".rstrip())
+    while True:
+        try:
+            return parse_selection(input("~> Download which files? [all]: "), len(urls))
+        except ValueError as error:
+            print(f"~> {error}")
+
+
+def page_cache(path, params):
+    args = parser.parse_args()
+    if not args.cache_ttl:
+        return None
+    key = hashlib.sha256(ujson.dumps(sorted(params.items())).encode()).hexdigest()[:12]
+    return args.cache_dir.joinpath(f"{path}-{key}.json")
+
+
+def cached_page(cache):
+    try:
+        if time.time() - cache.stat().st_mtime < parser.parse_args().cache_ttl:
+            return ujson.loads(cache.read_bytes())['result']
+    except (OSError, ValueError, KeyError, TypeError, RecursionError):
+        pass
+    return None
+
+
+async def fetch_page(session, link, content=True):
+    args = parser.parse_args()
+    path = page_path(link)
+    params = {'return_content': 'true' if content else 'false', **dict(args.api_param or [])}
+    cache = page_cache(path, params)
+    if cache and not args.no_cache and (result := cached_page(cache)) is not None:
+        print(f"~> {link} — using the cached page from {cache}") if args.explicit else None
+        return result
+
+    async for attempt in Retry(args.page_retries, args.retry_base_delay, args.retry_max_delay, args.retry_strategy):
+        try:
+            async with session.get(
+                    f"https://api.telegra.ph/getPage/{path}", params=params, headers={'X-Request-Id': run_id}
+            ) as response:
+                body = await response.read()
+        except aiohttp.ClientError as error:
+            failure = f"{type(error).__name__}: {error}"
+        else:
+            if response.status < 500:
+                break
+            failure = f"HTTP {response.status}"
+        print(f"~> {link} — attempt {attempt + 1} failed: {failure}") if args.explicit else None
+    else:
+        raise PageError(f"could not fetch the page: {failure}")
+
+    try:
+        page = ujson.loads(body)
+    except (ValueError, RecursionError) as error:
+        if 'depth' in str(error):
+            raise PageError(f"the page is nested deeper than the JSON decoder allows (about {MAX_DEPTH} levels)")
+        if looks_like_html(response.content_type, body):
+            raise PageError(f"expected JSON from the Telegraph API but got an HTML page (HTTP {response.status})")
+        raise PageError(f"invalid JSON from the Telegraph API (HTTP {response.status}): {error}, "
+                        f"body starts with {body[:80].decode(errors='replace')!r}")
+
+    if not isinstance(page, dict) or not page.get('ok') or not isinstance(page.get('result'), dict):
+        error = page.get('error') if isinstance(page, dict) else None
+        raise PageNotFoundError(f"the Telegraph API refused the page: {error or 'no result in the response'}")
+    if cache:
+        try:
+            cache.parent.mkdir(parents=True, exist_ok=True)
+            cache.write_bytes(body)
+        except OSError as error:
+            print(f"~> Could not cache the page in {cache}: {error}")
+    return page['result']
+
+
+async def probe_page(session, link):
+    try:
+        page = await fetch_page(session, link, content=False)
+    except PageError as error:
+        status = 'not-found' if isinstance(error, PageNotFoundError) else 'error'
+        print(f"~> {status}: {link}")
+        return {'link': link, 'status': status, 'error': str(error)}, error
+    print(f"~> ok: {link}")
+    return {'link': link, 'status': 'ok', 'title': page.get('title')}, None
+
+
+async def save_page(session, link):
+    page = await fetch_page(session, link)
+
+    warnings = []
+    if 'content' not in page:
+        warnings.append("The API returned the page without content, nothing to download")
+        print(f"~> {warnings[-1]}")
+    content = page.setdefault('content', [])
+    if pruned := limit_depth(content, parser.parse_args().max_depth):
+        warnings.append(f"Ignored content nested deeper than {parser.parse_args().max_depth} levels "
+                        f"({pruned} node(s) cut)")
+        print(f"~> {warnings[-1]}")
+
+    if parser.parse_args().tree:
+        print(f"~> {page['title']}", *render_tree(content, sources=media_sources()), sep="\n")
+        return {'link': link, 'title': page['title'],
+                'media_found': len(extract_media(content, media_sources())[0])}
+
+    checking = parser.parse_args().head_check or parser.parse_args().list_formats
+    to_stdout = str(parser.parse_args().folder) == '-' or parser.parse_args().stdout
+    temporary = (str(parser.parse_args().folder) == '@tmp' or to_stdout) and not checking
+    page_name = sanitize_filename(page['title']) or page['path']
+    folder = expand_folder(parser.parse_args().folder, page_name)
+    if temporary:
+        folder = pathlib.Path(tempfile.mkdtemp(prefix='tele-dl-'))
+    if parser.parse_args().subdir_by_title:
+        folder = folder.joinpath(page_name)
+
+    if (folder.exists() or folder.is_symlink()) and not folder.is_dir():
+        raise OutputError(f"output path {folder} exists and is not a directory")
+
+    old_size = getsize(folder)['raw']
+    target, created = folder, not folder.exists()
+    if parser.parse_args().atomic_run and not (checking or temporary):
+        folder = stage_folder(target, parser.parse_args().temp_dir)
+        staged_targets[folder] = target
+    start_time = datetime.now()
+    print(f"~> Started at: {datetime.now()}",
+          f"~> {'Checking' if checking else 'Saving'}: {page['title']}",
+          sep="\n")
+
+    report = {'link': link, 'run_id': run_id}
+    retries_before, metadata_before, paused_before = stats['retries'], stats['metadata_bytes'], stats['paused']
+    media, embeds, problems = extract_media(content, media_sources())
+    for problem in problems:
+        if parser.parse_args().parser_mode == 'strict':
+            print(f"~> Page structure: {problem}")
+        else:
+            print(f"~> Skipped {problem}") if parser.parse_args().explicit else None
+
+    if (max_media := parser.parse_args().max_media) and len(media) > max_media:
+        warnings.append(f"Page lists {len(media)} media files, only the first {max_media} are downloaded")
+        print(f"~> {warnings[-1]}")
+        media = media[:max_media]
+
+    urls = [media_url(item['src']) for item in media]
+    cover = None
+    if parser.parse_args().include_cover and page.get('image_url'):
+        if media_url(page['image_url']) in urls:
+            print("~> The cover image is already on the page") if parser.parse_args().explicit else None
+        else:
+            cover = len(urls)
+            media.append({'src': page['image_url'], 'tag': 'img', 'alt': '', 'caption': 'Cover'})
+            urls.append(media_url(page['image_url']))
+    print(f"~> Files in telegraph page: {len(urls)}") if parser.parse_args().explicit else None
+    repeated = {url: count for url, count in Counter(urls).items() if count > 1}
+    for url, count in repeated.items():
+        print(f"~> {url} appears {count} times on the page") if parser.parse_args().explicit else None
+    if not urls:
+        print(f"~> No media found on {link}")
+
+    if parser.parse_args().head_check:
+        checks = await asyncio.gather(*[check_url(session, link, url) for url in urls])
+        for check in checks:
+            print(f"~> {check['status'] or '---':>3} {'ok  ' if check['reachable'] else 'DEAD'} {check['url']}"
+                  f"{'  ' + check['error'] if check['error'] else ''}")
+        print(f"~> Reachable: {sum(check['reachable'] for check in checks)}/{len(checks)}")
+        report.update({'title': page['title'], 'media_found': len(urls), 'checks': checks,
+                       'failed': sum(not check['reachable'] for check in checks), 'warnings': warnings})
+        return report
+
+    if parser.parse_args().list_formats:
+        async def inspect(url):
+            async with host_semaphore(urlsplit(url).hostname), semaphore:
+                await pace_host(urlsplit(url).hostname)
+                return await remote_info(session, link, url)
+
+        formats = group_by_extension(await asyncio.gather(*[inspect(url) for url in urls]))
+        print(f"~> {'Extension':<10} {'Files':>5} {'Size':>12}  Types")
+        for group in formats:
+            size = f"{size_text(group['bytes'])}{'+' if group['unknown_size'] else ''}"
+            print(f"~> {group['extension']:<10} {group['files']:>5} {size:>12}  {', '.join(group['types']) or '-'}")
+        unknown = sum(group['unknown_size'] for group in formats)
+        print(f"~> Total: {len(urls)} files, {size_text(sum(group['bytes'] for group in formats))}"
+              f"{f' ({unknown} of unknown size)' if unknown else ''}")
+        report.update({'title': page['title'], 'media_found': len(urls), 'formats': formats, 'warnings': warnings})
+        return report
+
+    selection = list(range(len(urls)))
+    if parser.parse_args().interactive and urls:
+        selection = choose_media(media, urls)
+    if parser.parse_args().download_order == 'reverse':
+        selection.reverse()
+    if parser.parse_args().shuffle:
+        shuffler.shuffle(selection)
+
+    if to_stdout and temporary and len(selection) != 1:
+        shutil.rmtree(folder, ignore_errors=True)
+        raise OutputError(f"--stdout needs exactly one file to download, the page has {len(selection)}")
+
+    names = file_names(urls, prefix=not parser.parse_args().no_index_prefix,
+                       alts=[item['alt'] for item in media] if parser.parse_args().rename_from_alt else None,
+                       cover=cover)
+    page_names.clear()
+    page_names.update(names)
+    emit('parse', link=link, run_id=run_id, title=page['title'], media_found=len(urls), selected=len(selection),
+         embeds=len(embeds), problems=problems, warnings=warnings,
+         items=[{'id': file_id, 'url': url, 'name': names[file_id], 'tag': media[file_id]['tag']}
+                for file_id, url in enumerate(urls)])
+    progress = Progress(len(selection))
+    downloads = [asyncio.ensure_future(progress.track(download_file(
+        session,
+        link,
+        urls[file_id],
+        folder,
+        names[file_id],
+        file_id
+    ))) for file_id in selection]
+    try:
+        results = await asyncio.gather(*downloads)
+    except BaseException:
+        for download in downloads:
+            download.cancel()
+        await asyncio.gather(*downloads, return_exceptions=True)
+        remove_partial_files()
+        shutil.rmtree(folder, ignore_errors=True) if folder != target or temporary else None
+        staged_targets.pop(folder, None)
+        raise
+    results.sort(key=lambda result: result['id'])
+    statuses = [result['status'] for result in results]
+
+    if parser.parse_args().ytdlp and embeds:
+        if shutil.which('yt-dlp') is None:
+            print(f"~> yt-dlp not found in PATH, skipping {len(embeds)} embedded videos")
+        else:
+            saved = await asyncio.gather(*[download_embed(
                 url,
-                parser.parse_args().folder,
-                file_id
-            ) for file_id, url in enumerate(urls)])
+                folder
+            ) for url in embeds])
+            print(f"~> Embedded videos saved: {sum(saved)}/{len(embeds)}")
+            report['embeds_saved'] = sum(saved)
+
+    if parser.parse_args().convert:
+        await convert_files(results)
 
-            size = convert_bytes(getsize(parser.parse_args().folder)['raw'] - old_size)
-            print(f"~> Saved {size} to {parser.parse_args().folder}",
-                  f"~> Time elapsed: {datetime.now() - start_time}",
-                  sep="\n")
+    failed = statuses.count('failed') or statuses.count('blocked')
+    if folder != target:
+        if failed:
+            shutil.rmtree(folder, ignore_errors=True)
+            if created and target.is_dir() and not any(target.iterdir()):
+                target.rmdir()
+            print(f"~> Some downloads failed, {target} was left unchanged")
+            report['rolled_back'] = True
+            for result in results:
+                result['file'] = None if result['file'] and folder in result['file'].parents else result['file']
+        else:
+            for result in results:
+                result['file'] = (twin(result['file']) or result['file']) if result['file'] else None
+            commit_folder(folder, target)
+        staged_targets.pop(folder)
+        folder = target
+
+    kept = not report.get('rolled_back') and not (temporary and failed)
+    if (dedup := parser.parse_args().dedup_link) and kept:
+        print(f"~> Duplicates {'removed' if dedup == 'delete' else 'linked'}: "
+              f"{size_text(dedup_files(results, dedup))} saved")
+
+    if parser.parse_args().no_index_prefix and folder.is_dir() and kept:
+        folder.joinpath('order.txt').unlink(missing_ok=True)
+        folder.joinpath('order.txt').write_text(
+            ''.join(f"{result['file'].name}\n" for result in results if result['file']), encoding='utf-8'
+        )
+
+    saved_bytes = getsize(folder)['raw'] - old_size if kept else 0
+    if (parser.parse_args().thumbnails or parser.parse_args().contact_sheet) and kept:
+        sheet = parser.parse_args().contact_sheet
+        sheet = expand_folder(sheet, page_name) if sheet else None
+        write_thumbnails([result['file'] for result in results if result['file']], folder, sheet)
+
+    if parser.parse_args().html_index and kept:
+        folder.mkdir(parents=True, exist_ok=True)
+        folder.joinpath('index.html').unlink(missing_ok=True)
+        folder.joinpath('index.html').write_text(render_index(
+            page['title'],
+            page.get('author_name'),
+            page.get('url', link),
+            [((twin(result['file']) or result['file']).relative_to(target).as_posix(), media[result['id']]['tag'],
+              media[result['id']]['caption']) for result in results if result['file']]
+        ), encoding='utf-8')
+        print(f"~> Gallery: {target.joinpath('index.html')}")
+
+    if to_stdout and temporary:
+        if file := next((result['file'] for result in results if result['file']), None):
+            data_output.write(file.read_bytes())
+            data_output.flush()
+        shutil.rmtree(folder, ignore_errors=True)
+    elif temporary and failed:
+        shutil.rmtree(folder, ignore_errors=True)
+        print(f"~> Some downloads failed, removed the temporary folder {folder}")
+        report['rolled_back'] = True
+        saved_bytes = 0
+        for result in results:
+            result['file'] = None
+
+    if mirror := parser.parse_args().mirror:
+        mirror = expand_folder(mirror, page_name)
+        links = {result['url']: quote(os.path.relpath(result['file'], mirror.absolute().parent).replace(os.sep, '/'))
+                 for result in results if result['file']}
+        mirror.write_text(render_mirror(
+            page['title'],
+            page.get('author_name'),
+            page.get('url', link),
+            content,
+            links,
+            media_sources()
+        ), encoding='utf-8')
+        print(f"~> Mirror: {mirror}")
+
+    if (archive := parser.parse_args().archive) and folder.is_dir():
+        formats = {'zip': 'zip', 'tar': 'tar', 'tar.gz': 'gztar'}
+        print(f"~> Archive: {shutil.make_archive(str(folder), formats[archive], root_dir=folder)}")
+
+    if parser.parse_args().strip_metadata:
+        print(f"~> Metadata stripped: {size_text(stats['metadata_bytes'] - metadata_before)}")
+
+    if parser.parse_args().max_retries_total is not None:
+        print(f"~> Retry budget used: {stats['retries']}/{parser.parse_args().max_retries_total}")
+
+    if parser.parse_args().organize_by_type:
+        categories = Counter(result['file'].parent.name for result in results if result['file'])
+        print(f"~> By type: {', '.join(f'{name} {count}' for name, count in sorted(categories.items()))}")
+
+    extensions = Counter(file.suffix.lower().lstrip('.') or 'none'
+                         for file in {result['file'] for result in results if result['file']})
+    extensions = dict(sorted(extensions.items(), key=lambda item: (-item[1], item[0])))
+    if extensions:
+        print(f"~> By extension: {', '.join(f'{name} {count}' for name, count in extensions.items())}")
+
+    if parser.parse_args().small_file_threshold is not None:
+        tiers = {tier: {'files': sum(result.get('tier') == tier for result in results),
+                        'downloaded': sum(result.get('tier') == tier and result['status'] == 'downloaded'
+                                          for result in results),
+                        'bytes': sum(result['size'] or 0 for result in results if result.get('tier') == tier)}
+                 for tier in ('small', 'large')}
+        print(f"~> By size: " + ', '.join(f"{tier} {counts['downloaded']}/{counts['files']} "
+                                          f"({size_text(counts['bytes'])})" for tier, counts in tiers.items()))
+        report['tiers'] = tiers
+
+    if stats['paused'] > paused_before:
+        print(f"~> Paused for: {timedelta(seconds=round(stats['paused'] - paused_before))}")
+
+    if repeated:
+        print(f"~> Repeated URLs: {len(repeated)}, with {sum(repeated.values()) - len(repeated)} extra reference(s)")
+
+    if statuses.count('known'):
+        print(f"~> Skipped, content already saved: {statuses.count('known')}")
+
+    if statuses.count('missing'):
+        print(f"~> Not found (404), ignored: {statuses.count('missing')}")
+
+    if statuses.count('too-large'):
+        print(f"~> Skipped over the size limit: {statuses.count('too-large')}")
+
+    if statuses.count('blocked'):
+        print(f"~> Skipped after repeated host failures: {statuses.count('blocked')}")
+
+    if parser.parse_args().show_files:
+        for status, title, color in (('downloaded', 'Downloaded', '32'), ('skipped', 'Already saved', '33')):
+            names = [result['file'].name for result in results if result['status'] == status and result['file']]
+            print(f"~> {title}: {len(names)}") if names else None
+            for name in names[:SHOW_FILES_LIMIT]:
+                print(f"   {colored(name, color)}")
+            print(f"   ... and {len(names) - SHOW_FILES_LIMIT} more") if len(names) > SHOW_FILES_LIMIT else None
+
+    for result in results:
+        print(f"~> Failed: {colored(result['name'], '31')}: {result['error']}") if result['error'] else None
+
+    print(f"~> Saved {size_text(saved_bytes)} to {'standard output' if to_stdout else folder}",
+          f"~> Time elapsed: {datetime.now() - start_time}",
+          sep="\n")
+
+    report.update({
+        'title': page['title'],
+        'folder': '-' if to_stdout else str(folder),
+        'started': start_time.isoformat(),
+        'elapsed': (datetime.now() - start_time).total_seconds(),
+        'media_found': len(urls),
+        'downloaded': statuses.count('downloaded'),
+        'skipped': statuses.count('skipped'),
+        'failed': statuses.count('failed'),
+        'blocked': statuses.count('blocked'),
+        'too_large': statuses.count('too-large'),
+        'missing': statuses.count('missing'),
+        'known': statuses.count('known'),
+        'retries': stats['retries'] - retries_before,
+        'saved_bytes': saved_bytes,
+        'extensions': extensions,
+        'duplicate_urls': {url: count - 1 for url, count in repeated.items()},
+        'errors': [{'file': result['name'], 'url': result['url'], 'error': result['error']}
+                   for result in results if result['error']],
+        'structure_errors': problems if parser.parse_args().parser_mode == 'strict' else [],
+        'warnings': warnings
+    })
+    return report
+
+
+def append_history(reports):
+    fields = ('run_id', 'link', 'title', 'folder', 'started', 'elapsed', 'media_found', 'downloaded', 'skipped',
+              'failed', 'error')
+    lines = ''.join(ujson.dumps({field: report[field] for field in fields if field in report}) + '\n'
+                    for report in reports)
+    try:
+        parser.parse_args().history_file.parent.mkdir(parents=True, exist_ok=True)
+        with open(parser.parse_args().history_file, 'a', encoding='utf-8') as history:
+            history.write(lines)
+    except OSError as error:
+        print(f"~> Could not write the history file: {error}")
+
+
+def show_history(path, count):
+    try:
+        lines = path.read_text(encoding='utf-8').splitlines()[-count:]
+    except FileNotFoundError:
+        lines = []
+    for line in lines:
+        run = ujson.loads(line)
+        started = run['started'][:19].replace('T', ' ')
+        if 'error' in run:
+            print(f"~> {started}  {run['link']}  failed: {run['error']}")
+            continue
+        print(f"~> {started}  {run['link']}  {run['downloaded']} downloaded, {run['skipped']} skipped, "
+              f"{run['failed']} failed in {run['elapsed']:.1f}s -> {run['folder']}")
+    return 0
+
+
+def remove_partial_files():
+    for path in partial_files:
+        try:
+            long_path(path).unlink(missing_ok=True)
+        except OSError:
+            pass
+    print(f"~> Removed {len(partial_files)} partially written files") if partial_files else None
+    partial_files.clear()
+
+
+def toggle_pause():
+    if running.is_set():
+        running.clear()
+        stats['paused_at'] = time.monotonic()
+        print("~> Paused, in-flight downloads will finish. Send SIGUSR1 again to resume")
+    else:
+        stats['paused'] += time.monotonic() - stats['paused_at']
+        running.set()
+        print("~> Resumed")
+
+
+async def main(links):
+    if hasattr(signal, 'SIGUSR1'):
+        asyncio.get_running_loop().add_signal_handler(signal.SIGUSR1, toggle_pause)
+    connector = aiohttp.TCPConnector(limit=0, limit_per_host=parser.parse_args().max_conns_per_host,
+                                     keepalive_timeout=parser.parse_args().keepalive_timeout,
+                                     ttl_dns_cache=parser.parse_args().dns_cache_ttl,
+                                     resolver=PinnedResolver(dict(parser.parse_args().resolve))
+                                     if parser.parse_args().resolve else None)
+    async with aiohttp.ClientSession(json_serialize=ujson.dumps, headers={'Connection': 'keep-alive'},
+                                     connector=connector) as session:
+        reports, errors = [], []
+        for link in links:
+            if parser.parse_args().probe:
+                report, error = await probe_page(session, link)
+                reports.append(report)
+                errors.extend([error] if error else [])
+                emit('summary', **report)
+                continue
+            try:
+                reports.append(await save_page(session, link))
+            except PageError as error:
+                print(f"~> Could not save {link}: {error}")
+                reports.append({'link': link, 'run_id': run_id, 'started': datetime.now().isoformat(),
+                                'error': str(error), 'media_found': 0})
+                errors.append(error)
+            emit('summary', **reports[-1])
+
+    report = reports[0] if len(reports) == 1 else reports
+    report = ujson.dumps(report) if parser.parse_args().json_compact else ujson.dumps(report, indent=2)
+    if parser.parse_args().json:
+        parser.parse_args().json.write_text(report)
+    if parser.parse_args().result_fd is not None:
+        with open(parser.parse_args().result_fd, 'w', closefd=False) as stream:
+            stream.write(report + '\n')
+
+    args = parser.parse_args()
+    if not (args.no_history or args.probe or args.tree or args.head_check or args.list_formats):
+        append_history(reports)
+
+    failures = [{'link': report['link'], **error} for report in reports for error in report.get('errors', [])]
+    failures += [{'link': report['link'], 'error': report['error']} for report in reports if 'error' in report]
+    if parser.parse_args().failures_file and failures:
+        parser.parse_args().failures_file.write_text(''.join(f"{ujson.dumps(failure)}\n" for failure in failures))
+        print(f"~> Failures: {len(failures)} written to {parser.parse_args().failures_file}")
+
+    if parser.parse_args().fail_if_empty and any(report.get('media_found') == 0 for report in reports):
+        errors.append(NoMediaError())
+    if any(report.get('structure_errors') for report in reports):
+        errors.append(StructureError())
+    if any(report.get('failed') or report.get('blocked') for report in reports):
+        errors.append(PartialFailureError())
+    if errors:
+        raise SystemExit(errors[0].exit_code)
 
 
 if __name__ == '__main__':
     parser = arguments()
-    semaphore = asyncio.Semaphore(50)
+    data_output = event_output = None
+    if parser.parse_args().events == 'json' and (str(parser.parse_args().folder) == '-' or parser.parse_args().stdout):
+        parser.error("--events json cannot be combined with --stdout")
+    if str(parser.parse_args().folder) == '-' or parser.parse_args().stdout:
+        data_output, sys.stdout = sys.stdout.buffer, sys.stderr
+    if parser.parse_args().events == 'json':
+        event_output, sys.stdout = sys.stdout, sys.stderr
+    if parser.parse_args().ascii or (sys.stdout.encoding or '').lower().replace('-', '') != 'utf8':
+        sys.stdout = AsciiOutput(sys.stdout)
+    if parser.parse_args().verify:
+        raise SystemExit(verify_manifest(parser.parse_args().verify, expand_folder(parser.parse_args().folder, '')))
+    if parser.parse_args().history is not None:
+        raise SystemExit(show_history(parser.parse_args().history_file, parser.parse_args().history))
+    if parser.parse_args().serve:
+        raise SystemExit(serve(expand_folder(parser.parse_args().folder, ''), parser.parse_args().serve,
+                               parser.parse_args().serve_address))
+    if not parser.parse_args().link and not parser.parse_args().stdin:
+        parser.error("the following arguments are required: --link/-L")
+    if parser.parse_args().interactive and (parser.parse_args().stdin or parser.parse_args().link == '-'):
+        parser.error("--interactive cannot be combined with reading links from standard input")
+    if parser.parse_args().interactive and not sys.stdin.isatty():
+        parser.error("--interactive needs a terminal")
+    if parser.parse_args().shuffle and parser.parse_args().download_order != 'document':
+        parser.error("--shuffle cannot be combined with --download-order reverse")
+    if any(key == 'path' for key, _ in parser.parse_args().api_param or []):
+        parser.error("--api-param cannot override the page path")
+    if parser.parse_args().temp_dir and not parser.parse_args().atomic_run:
+        parser.error("--temp-dir only applies to --atomic-run")
+    if data_output and (parser.parse_args().stdin or parser.parse_args().link == '-'):
+        parser.error("--stdout cannot be combined with reading links from standard input")
+    if data_output and (parser.parse_args().mirror or parser.parse_args().archive or parser.parse_args().contact_sheet):
+        parser.error("--stdout cannot be combined with --mirror, --archive or --contact-sheet")
+    if (parser.parse_args().basic_auth or parser.parse_args().bearer_token) and not parser.parse_args().auth_host:
+        parser.error("--basic-auth and --bearer-token require --auth-host")
+
+    try:
+        credentials = None if parser.parse_args().no_netrc else load_netrc(parser.parse_args().netrc)
+    except (OSError, netrc.NetrcParseError) as error:
+        raise SystemExit(f"~> Could not read the netrc file: {error}")
+    semaphore = asyncio.Semaphore(max(1, parser.parse_args().workers))
+    tier_semaphores = {'small': asyncio.Semaphore(max(1, parser.parse_args().workers)),
+                       'large': asyncio.Semaphore(parser.parse_args().large_workers)}
+    breakers = Breaker(parser.parse_args().breaker_threshold, parser.parse_args().breaker_cooldown)
+    host_semaphores = {}
+    host_windows = {}
+    known_content = {}
+    running = asyncio.Event()
+    running.set()
+    if parser.parse_args().only_new:
+        root = expand_folder(parser.parse_args().folder, '')
+        known_content = {sha256sum(file): file.relative_to(root).as_posix() for file in root.glob('**/*')
+                         if file.is_file()}
+    stats = Counter()
+    partial_files = set()
+    page_names = set()
+    staged_targets = {}
+    inflight = ByteBudget(parser.parse_args().max_inflight_bytes or float('inf'))
+    shuffler = random.Random(parser.parse_args().seed)
+    run_id = parser.parse_args().request_id or uuid.uuid4().hex
+    print(f"~> Run id: {run_id}") if parser.parse_args().explicit else None
+    if parser.parse_args().stdin or parser.parse_args().link == '-':
+        links = [line.strip() for line in sys.stdin if line.strip()]
+        if not links:
+            raise SystemExit("~> No links given on standard input")
+    else:
+        links = [parser.parse_args().link]
+
+    for option, path in (('--mirror', parser.parse_args().mirror),
+                         ('--contact-sheet', parser.parse_args().contact_sheet)):
+        if len(links) > 1 and path and '{title}' not in str(path):
+            parser.error(f"{option} needs {{title}} in its path when saving several pages")
+
     loop = asyncio.get_event_loop()
-    loop.run_until_complete(main())
+    try:
+        loop.run_until_complete(asyncio.wait_for(main(links), parser.parse_args().timeout or None))
+    except asyncio.TimeoutError:
+        raise SystemExit(f"~> Timed out after {parser.parse_args().timeout} seconds")
+    except Exception as error:
+        traceback.print_exc() if parser.parse_args().explicit else None
+        raise SystemExit(f"~> Unexpected {type(error).__name__}: {error}\n"
+                         f"~> This is a bug, please report it with the run id {run_id} and the output of -E")
+    finally:
+        remove_partial_files()
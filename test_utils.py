@@ -0,0 +1,482 @@
+import argparse
+import asyncio
+import contextlib
+import io
+import os
+import pathlib
+import tempfile
+import unittest
+from unittest import mock
+
+from errors import InvalidURLError
+from utils import expand_folder, non_negative_int, positive_int, arguments, retry_delay, Retry, Breaker, \
+    sniff_type, sniffed_name, strip_metadata, gallery_entries, render_index, \
+    parse_bytes, SizeLimit, convert_bytes, extract_media, render_nodes, render_tree, node_text, limit_depth, \
+    depth_limit, MAX_DEPTH, file_names, duration, page_path, host_address, \
+    media_source, refresh_target, group_by_extension
+
+
+class ExpandFolderTest(unittest.TestCase):
+    def test_home(self):
+        with mock.patch.dict(os.environ, {'HOME': '/home/me'}):
+            self.assertEqual(expand_folder('~/Downloads', 'Page'), pathlib.Path('/home/me/Downloads'))
+
+    def test_variables(self):
+        with mock.patch.dict(os.environ, {'PAGE': 'pages'}):
+            self.assertEqual(expand_folder('out/$PAGE/${PAGE}', 'Page'), pathlib.Path('out/pages/pages'))
+        with mock.patch.dict(os.environ, clear=True):
+            self.assertEqual(expand_folder('out/$MISSING', 'Page'), pathlib.Path('out/$MISSING'))
+
+    def test_title(self):
+        self.assertEqual(expand_folder('out/{title}/{title}', 'My Page'), pathlib.Path('out/My Page/My Page'))
+        self.assertEqual(expand_folder('out', 'My Page'), pathlib.Path('out'))
+
+    def test_title_is_not_expanded(self):
+        with mock.patch.dict(os.environ, {'HOME': '/home/me', 'USER': 'me'}):
+            self.assertEqual(expand_folder('~/{title}', '$USER costs ~$5'), pathlib.Path('/home/me/$USER costs ~$5'))
+
+
+class NumberTest(unittest.TestCase):
+    def test_positive_int(self):
+        self.assertEqual(positive_int('1'), 1)
+        self.assertEqual(positive_int('50'), 50)
+        for value in ('0', '-1', '', 'abc', '1.5', '2x'):
+            with self.assertRaises(argparse.ArgumentTypeError, msg=value):
+                positive_int(value)
+
+    def test_non_negative_int(self):
+        self.assertEqual(non_negative_int('0'), 0)
+        self.assertEqual(non_negative_int('3'), 3)
+        for value in ('-1', '', 'abc', '1.5', ' 1'):
+            with self.assertRaises(argparse.ArgumentTypeError, msg=value):
+                non_negative_int(value)
+
+    def test_flags(self):
+        for flags in (['--workers', '0'], ['--workers', '-2'], ['--retries', '-1'], ['--timeout', '-1'],
+                      ['--max-conns-per-host', '0']):
+            with self.assertRaises(SystemExit, msg=flags), contextlib.redirect_stderr(io.StringIO()):
+                arguments().parse_args(flags)
+
+
+class PagePathTest(unittest.TestCase):
+    def test_links(self):
+        self.assertEqual(page_path('https://telegra.ph/Test-01-01'), 'Test-01-01')
+        self.assertEqual(page_path('telegra.ph/Test-01-01/'), 'Test-01-01')
+        self.assertEqual(page_path('http://graph.org/Test-01-01?ref=x'), 'Test-01-01')
+        self.assertEqual(page_path('Test-01-01'), 'Test-01-01')
+
+    def test_invalid(self):
+        for link in ('https://example.com/Test-01-01', 'https://telegra.ph/', 'https://telegra.ph/file/a.jpg',
+                     'ftp://telegra.ph/Test-01-01'):
+            with self.assertRaises(InvalidURLError, msg=link):
+                page_path(link)
+
+
+class RetryDelayTest(unittest.TestCase):
+    def test_exponential(self):
+        self.assertEqual([retry_delay(attempt, 1, 60, 'exponential') for attempt in range(1, 5)], [1, 2, 4, 8])
+
+    def test_linear(self):
+        self.assertEqual([retry_delay(attempt, 2, 60, 'linear') for attempt in range(1, 4)], [2, 4, 6])
+
+    def test_capped(self):
+        self.assertEqual(retry_delay(10, 1, 30, 'exponential'), 30)
+        self.assertEqual(retry_delay(10, 5, 30, 'linear'), 30)
+
+
+class RetryTest(unittest.TestCase):
+    def attempts(self, retry):
+        async def collect():
+            return [attempt async for attempt in retry]
+        return asyncio.run(collect())
+
+    def test_sleeps_between_attempts(self):
+        delays = []
+
+        async def sleep(delay):
+            delays.append(delay)
+        self.assertEqual(self.attempts(Retry(3, 1, 10, 'exponential', sleep=sleep)), [0, 1, 2, 3])
+        self.assertEqual(delays, [1, 2, 4])
+
+    def test_spend(self):
+        budget, delays = [2], []
+
+        def spend():
+            budget[0] -= 1
+            return budget[0] >= 0
+
+        async def sleep(delay):
+            delays.append(delay)
+        retry = Retry(5, 1, 10, 'linear', spend, sleep)
+        self.assertEqual(self.attempts(retry), [0, 1, 2])
+        self.assertEqual(delays, [1, 2])
+        self.assertTrue(retry.exhausted)
+
+
+class BreakerTest(unittest.TestCase):
+    def setUp(self):
+        self.now = 0
+        self.breaker = Breaker(3, 30, clock=lambda: self.now)
+
+    def test_trips_after_threshold(self):
+        for _ in range(2):
+            self.breaker.record('cdn.example.com', False)
+        self.assertFalse(self.breaker.tripped('cdn.example.com'))
+        self.breaker.record('cdn.example.com', False)
+        self.assertTrue(self.breaker.tripped('cdn.example.com'))
+        self.assertFalse(self.breaker.tripped('telegra.ph'))
+
+    def test_recovers_after_cooldown(self):
+        for _ in range(3):
+            self.breaker.record('cdn.example.com', False)
+        self.now = 29
+        self.assertTrue(self.breaker.tripped('cdn.example.com'))
+        self.now = 30
+        self.assertFalse(self.breaker.tripped('cdn.example.com'))
+
+    def test_success_resets(self):
+        for _ in range(2):
+            self.breaker.record('cdn.example.com', False)
+        self.breaker.record('cdn.example.com', True)
+        self.breaker.record('cdn.example.com', False)
+        self.assertFalse(self.breaker.tripped('cdn.example.com'))
+
+    def test_disabled(self):
+        breaker = Breaker(0, 30, clock=lambda: self.now)
+        for _ in range(10):
+            breaker.record('cdn.example.com', False)
+        self.assertFalse(breaker.tripped('cdn.example.com'))
+
+
+class SniffTypeTest(unittest.TestCase):
+    def test_signatures(self):
+        self.assertEqual(sniff_type(b'\xff\xd8\xff\xe0\x00\x10JFIF'), ('image/jpeg', '.jpg'))
+        self.assertEqual(sniff_type(b'\x89PNG\r\n\x1a\n\x00\x00'), ('image/png', '.png'))
+        self.assertEqual(sniff_type(b'GIF89a\x01\x00'), ('image/gif', '.gif'))
+        self.assertEqual(sniff_type(b'RIFF\x00\x00\x00\x00WEBPVP8 '), ('image/webp', '.webp'))
+        self.assertEqual(sniff_type(b'%PDF-1.7'), ('application/pdf', '.pdf'))
+        self.assertIsNone(sniff_type(b'<!doctype html>'))
+        self.assertIsNone(sniff_type(b''))
+
+    def test_ftyp_brands(self):
+        self.assertEqual(sniff_type(b'\x00\x00\x00\x18ftypisom'), ('video/mp4', '.mp4'))
+        self.assertEqual(sniff_type(b'\x00\x00\x00\x14ftypqt  '), ('video/quicktime', '.mov'))
+        self.assertEqual(sniff_type(b'\x00\x00\x00\x18ftypM4A '), ('audio/mp4', '.m4a'))
+        self.assertEqual(sniff_type(b'\x00\x00\x00\x18ftypheic'), ('image/heic', '.heic'))
+        self.assertIsNone(sniff_type(b'\x00\x00\x00\x18ftypabcd'))
+
+    def test_sniffed_name(self):
+        self.assertEqual(sniffed_name('a.jpg', '.png', {'a.jpg'}), 'a.png')
+        self.assertEqual(sniffed_name('a.jpg', '.png', {'a.jpg', 'a.png', 'a_1.png'}), 'a_2.png')
+        self.assertEqual(sniffed_name('0_a.jpg', '.png', {'0_a.jpg', 'a.png'}), '0_a.png')
+
+
+class StripMetadataTest(unittest.TestCase):
+    def test_jpeg(self):
+        app0 = b'\xff\xe0\x00\x04ab'
+        exif = b'\xff\xe1\x00\x06Exif'
+        iptc = b'\xff\xed\x00\x04ip'
+        comment = b'\xff\xfe\x00\x03c'
+        scan = b'\xff\xda\x00\x02\xff\xe1data\xff\xd9'
+        self.assertEqual(strip_metadata(b'\xff\xd8' + app0 + exif + iptc + comment + scan),
+                         b'\xff\xd8' + app0 + scan)
+
+    def test_png(self):
+        def chunk(kind, data):
+            return len(data).to_bytes(4, 'big') + kind + data + b'crc!'
+
+        signature = b'\x89PNG\r\n\x1a\n'
+        header, end = chunk(b'IHDR', b'x' * 13), chunk(b'IEND', b'')
+        body = signature + header + chunk(b'tEXt', b'Author\x00me') + chunk(b'eXIf', b'exif') + end
+        self.assertEqual(strip_metadata(body), signature + header + end)
+
+    def test_other_types_untouched(self):
+        self.assertEqual(strip_metadata(b'GIF89a...'), b'GIF89a...')
+        self.assertEqual(strip_metadata(b'\x00\x00\x00\x18ftypisom'), b'\x00\x00\x00\x18ftypisom')
+
+
+class NodeTextTest(unittest.TestCase):
+    def test_nested_text(self):
+        self.assertEqual(node_text({'tag': 'p', 'children': ['a', {'tag': 'b', 'children': ['b']}, 'c']}), 'abc')
+
+
+class GalleryTest(unittest.TestCase):
+    def test_entries(self):
+        with tempfile.TemporaryDirectory() as folder:
+            folder = pathlib.Path(folder)
+            for name in ('0_a.jpg', '1_b.mp4', 'order.txt', 'thumbnails/0_a.jpg'):
+                folder.joinpath(name).parent.mkdir(exist_ok=True)
+                folder.joinpath(name).write_bytes(b'x')
+            self.assertEqual(gallery_entries(folder), [('0_a.jpg', 'img', None), ('1_b.mp4', 'video', None)])
+
+    def test_images_are_drawn(self):
+        body = render_index('t', None, None, [('a.jpg', 'img', None), ('b.mp4', 'video', None)])
+        self.assertIn('<img src="a.jpg"', body)
+        self.assertIn('<video src="b.mp4"', body)
+
+
+class ConvertBytesTest(unittest.TestCase):
+    def test_boundaries(self):
+        expected = {'legacy': ['1000.00 bytes', '1023.00 bytes', '1.00 KB'],
+                    'binary': ['1000.00 bytes', '1023.00 bytes', '1.00 KiB'],
+                    'decimal': ['1.00 kB', '1.02 kB', '1.02 kB']}
+        for units, sizes in expected.items():
+            self.assertEqual([convert_bytes(size, units) for size in (1000, 1023, 1024)], sizes, msg=units)
+
+    def test_precision(self):
+        self.assertEqual(convert_bytes(1536, 'legacy', 0), '2 KB')
+        self.assertEqual(convert_bytes(1536, 'decimal', 3), '1.536 kB')
+
+
+class ParseBytesTest(unittest.TestCase):
+    def test_units(self):
+        self.assertEqual(parse_bytes('500'), 500)
+        self.assertEqual(parse_bytes('1K'), 1024)
+        self.assertEqual(parse_bytes('1KB'), 1024)
+        self.assertEqual(parse_bytes('1.5 MiB'), 1572864)
+        self.assertEqual(parse_bytes('.5k'), 512)
+
+    def test_invalid(self):
+        for value in ('', 'MB', '10 parsecs', '-1K'):
+            with self.assertRaises(ValueError, msg=value):
+                parse_bytes(value)
+
+    def test_printed_sizes(self):
+        for size in (1536, 5 * 1024 ** 2, 3 * 1024 ** 3):
+            for units in ('legacy', 'binary'):
+                self.assertEqual(parse_bytes(convert_bytes(size, units)), size, msg=units)
+
+    def test_size_limit_text(self):
+        self.assertEqual(SizeLimit('100MB').text, '100MB')
+        self.assertEqual(SizeLimit('2048').text, '2048 bytes')
+        self.assertEqual(SizeLimit('2048'), 2048)
+
+
+class ExtractMediaTest(unittest.TestCase):
+    content = [{'tag': 'figure', 'children': [{'tag': 'img', 'attrs': {'src': '/file/a.jpg'}},
+                                              {'tag': 'figcaption', 'children': ['A']}]},
+               {'tag': 'img', 'attrs': {'alt': 'no source'}}, {'tag': 'video', 'attrs': {'src': ' '}},
+               {'tag': 'iframe'}, 7, 'text', {'tag': 'p', 'children': 'x'}]
+
+    def test_lenient_and_strict_counts(self):
+        media, embeds, problems = extract_media(self.content)
+        self.assertEqual(media, [{'src': '/file/a.jpg', 'tag': 'img', 'alt': None, 'caption': 'A'}])
+        self.assertEqual(embeds, [])
+        self.assertEqual(len(problems), 5)
+        self.assertEqual(problems[1:], ['<video> without src', '<iframe> without src', 'unexpected int node',
+                                        '<p> has malformed attrs or children'])
+
+    def test_embed_and_object(self):
+        content = [{'tag': 'embed', 'attrs': {'src': '/file/doc.pdf'}},
+                   {'tag': 'object', 'attrs': {'data': '/file/clip.mp4', 'src': '/file/other.mp4'}},
+                   {'tag': 'object', 'attrs': {'src': '/file/ignored.pdf'}}]
+        media, _, problems = extract_media(content)
+        self.assertEqual([(item['tag'], item['src']) for item in media],
+                         [('embed', '/file/doc.pdf'), ('object', '/file/clip.mp4')])
+        self.assertEqual(problems, ['<object> without data'])
+
+
+class MediaSourceTest(unittest.TestCase):
+    names = ('src', 'data-src', 'data-original')
+
+    def test_first_attribute(self):
+        self.assertEqual(media_source({'src': '/file/a.jpg', 'data-src': '/file/b.jpg'}, self.names), '/file/a.jpg')
+        self.assertEqual(media_source({'data-original': '/file/c.jpg'}, self.names), '/file/c.jpg')
+
+    def test_skips_placeholders(self):
+        self.assertEqual(media_source({'src': '/img/blank.gif', 'data-src': '/file/b.jpg'}, self.names),
+                         '/file/b.jpg')
+        self.assertEqual(media_source({'src': 'data:image/gif;base64,R0lGOD', 'data-original': '/file/c.png'},
+                                      self.names), '/file/c.png')
+
+    def test_placeholder_only(self):
+        self.assertEqual(media_source({'src': '/img/spacer.gif'}, self.names), '/img/spacer.gif')
+        self.assertIsNone(media_source({'src': 'data:image/gif;base64,R0lGOD'}, self.names))
+
+    def test_ignores_blank_and_other_values(self):
+        self.assertIsNone(media_source({'src': '  ', 'data-src': None, 'alt': '/file/a.jpg'}, self.names))
+
+
+class RenderNodesTest(unittest.TestCase):
+    def test_text_is_escaped(self):
+        self.assertEqual(render_nodes([{'tag': 'p', 'children': ['<b> & ', {'tag': 'br'}]}], {}),
+                         '<p>&lt;b&gt; &amp; <br></p>')
+
+    def test_unknown_tags_and_attributes(self):
+        nodes = [{'tag': 'script', 'children': ['alert(1)']},
+                 {'tag': 'p', 'attrs': {'onclick="x" y': '1', 'style': 'color: red'}, 'children': ['text']}]
+        self.assertEqual(render_nodes(nodes, {}), 'alert(1)<p>text</p>')
+
+    def test_links(self):
+        def link(href):
+            return render_nodes([{'tag': 'a', 'attrs': {'href': href}, 'children': ['x']}], {})
+
+        self.assertEqual(link('/Other-01-01'), '<a href="https://telegra.ph/Other-01-01">x</a>')
+        self.assertEqual(link('https://example.com/?a=1&b=2'), '<a href="https://example.com/?a=1&amp;b=2">x</a>')
+        self.assertEqual(link('#part-2'), '<a href="#part-2">x</a>')
+        for href in ('javascript:alert(1)', ' JavaScript:alert(1)', 'java\tscript:alert(1)', 'data:text/html,x'):
+            self.assertEqual(link(href), '<a>x</a>', msg=href)
+
+    def test_local_media(self):
+        links = {'https://telegra.ph/file/a.jpg': '0_a.jpg'}
+        self.assertEqual(render_nodes([{'tag': 'img', 'attrs': {'src': '/file/a.jpg', 'alt': 'A "cat"'}}], links),
+                         '<img src="0_a.jpg" alt="A &quot;cat&quot;">')
+        self.assertEqual(render_nodes([{'tag': 'video', 'attrs': {'src': '/file/b.mp4'}}], links),
+                         '<video src="https://telegra.ph/file/b.mp4" controls></video>')
+
+
+class RenderTreeTest(unittest.TestCase):
+    def test_tree(self):
+        content = [{'tag': 'p', 'children': ['Hello ', {'tag': 'b', 'children': ['world']}]},
+                   {'tag': 'figure', 'children': [{'tag': 'img', 'attrs': {'src': '/file/a.jpg'}},
+                                                  {'tag': 'iframe', 'attrs': {'src': '/embed/youtube?url=x'}}]}]
+        self.assertEqual(render_tree(content), ['<p>', '  "Hello"', '  <b>', '    "world"', '<figure>',
+                                                '  <img> /file/a.jpg [media]',
+                                                '  <iframe> /embed/youtube?url=x [embed]'])
+
+    def test_long_text(self):
+        self.assertEqual(render_tree(['x' * 70]), [f'"{"x" * 60}..."'])
+
+
+class MalformedContentTest(unittest.TestCase):
+    def setUp(self):
+        self.content = [5, None, {'tag': ['img'], 'attrs': 'src'}, {'tag': 'p', 'attrs': ['x'], 'children': 7},
+                        {'tag': 'p', 'children': ['a', 3.5, {'tag': 'b', 'children': 'bold'}]}]
+
+    def test_tree(self):
+        self.assertEqual(render_tree(self.content), ['[unexpected int node]', '[unexpected NoneType node]',
+                                                     '<None>', '<p>', '<p>', '  "a"',
+                                                     '  [unexpected float node]', '  <b>'])
+
+    def test_mirror(self):
+        self.assertEqual(render_nodes(self.content, {}), '<p></p><p>a<b></b></p>')
+
+    def test_text(self):
+        self.assertEqual(node_text(self.content[-1]), 'a')
+
+    def test_depth(self):
+        self.assertEqual(limit_depth(self.content, 1), 1)
+
+
+class DepthTest(unittest.TestCase):
+    def deep(self, levels):
+        node = 'x'
+        for _ in range(levels):
+            node = {'tag': 'b', 'children': [node]}
+        return node
+
+    def test_limit_depth(self):
+        content = [self.deep(5000), self.deep(3)]
+        self.assertEqual(limit_depth(content, 10), 1)
+        self.assertEqual(limit_depth(content, 10), 0)
+        self.assertEqual(node_text(content[0]), '')
+        self.assertEqual(node_text(content[1]), 'x')
+
+    def test_deep_content(self):
+        node = self.deep(5000)
+        self.assertEqual(node_text(node), 'x')
+        self.assertTrue(render_nodes([node], {}).startswith('<b><b>'))
+
+    def test_depth_limit(self):
+        self.assertEqual(depth_limit('20'), 20)
+        self.assertEqual(depth_limit(str(MAX_DEPTH)), MAX_DEPTH)
+        for value in ('0', str(MAX_DEPTH + 1)):
+            with self.assertRaises(argparse.ArgumentTypeError):
+                depth_limit(value)
+
+
+class FileNamesTest(unittest.TestCase):
+    def test_prefix(self):
+        self.assertEqual(file_names(['https://telegra.ph/file/a.jpg', 'https://telegra.ph/file/a.jpg']),
+                         ['0_a.jpg', '1_a.jpg'])
+
+    def test_collisions_without_prefix(self):
+        self.assertEqual(file_names(['https://telegra.ph/file/a.jpg'] * 3, prefix=False),
+                         ['a.jpg', 'a_1.jpg', 'a_2.jpg'])
+
+    def test_unsafe_names(self):
+        self.assertEqual(file_names(['https://example.com/x/..\\..\\run.bat', 'https://example.com/..'],
+                                    prefix=False), ['_.._run.bat', 'file'])
+
+    def test_cover_keeps_its_name(self):
+        self.assertEqual(file_names(['https://telegra.ph/file/cover.jpg', 'https://telegra.ph/file/c.jpg'],
+                                    prefix=False, cover=1), ['cover_1.jpg', 'cover.jpg'])
+
+    def test_alts(self):
+        self.assertEqual(file_names(['https://telegra.ph/file/a.jpg', 'https://telegra.ph/file/b.png'],
+                                    alts=['A  sunny: day', None]),
+                         ['0_A sunny_ day.jpg', '1_b.png'])
+        self.assertEqual(file_names(['https://telegra.ph/file/a.jpg'], alts=['  ']), ['0_a.jpg'])
+
+
+class ManyFileNamesTest(unittest.TestCase):
+    def test_many_identical_names(self):
+        names = file_names(['https://telegra.ph/file/a.jpg'] * 20000, prefix=False)
+        self.assertEqual(len(set(names)), 20000)
+        self.assertEqual(names[:3] + names[-1:], ['a.jpg', 'a_1.jpg', 'a_2.jpg', 'a_19999.jpg'])
+
+    def test_suffix_taken_by_another_file(self):
+        urls = ['https://telegra.ph/file/a.jpg', 'https://telegra.ph/file/a_1.jpg'] + \
+            ['https://telegra.ph/file/a.jpg'] * 2
+        self.assertEqual(file_names(urls, prefix=False), ['a.jpg', 'a_1.jpg', 'a_2.jpg', 'a_3.jpg'])
+
+
+class DurationTest(unittest.TestCase):
+    def test_seconds(self):
+        self.assertEqual(duration('90'), 90)
+        self.assertEqual(duration('1.5'), 1.5)
+        self.assertEqual(duration('0'), 0)
+
+    def test_units(self):
+        self.assertEqual(duration('30s'), 30)
+        self.assertEqual(duration('1m'), 60)
+        self.assertEqual(duration('1m30s'), 90)
+        self.assertEqual(duration('500ms'), 0.5)
+        self.assertEqual(duration(' 2H '), 7200)
+
+    def test_invalid(self):
+        for value in ('', 'soon', '5d', '-1', '1m 30s', 's', '1.s'):
+            with self.assertRaises(argparse.ArgumentTypeError, msg=value):
+                duration(value)
+
+
+class HostAddressTest(unittest.TestCase):
+    def test_addresses(self):
+        self.assertEqual(host_address('Telegra.ph:1.2.3.4'), ('telegra.ph', '1.2.3.4'))
+        self.assertEqual(host_address('telegra.ph:[::1]'), ('telegra.ph', '::1'))
+
+    def test_invalid(self):
+        for value in ('telegra.ph', ':1.2.3.4', 'telegra.ph:example.com'):
+            with self.assertRaises(argparse.ArgumentTypeError, msg=value):
+                host_address(value)
+
+
+class RefreshTargetTest(unittest.TestCase):
+    base = 'https://telegra.ph/file/a.jpg'
+
+    def test_meta_refresh(self):
+        body = b'<html><meta http-equiv="Refresh" content="0; url=\'/file/b.jpg\'"></html>'
+        self.assertEqual(refresh_target(body, self.base), 'https://telegra.ph/file/b.jpg')
+
+    def test_script(self):
+        body = b'<script>window.location.replace("https://cdn.example.com/b.jpg")</script>'
+        self.assertEqual(refresh_target(body, self.base), 'https://cdn.example.com/b.jpg')
+
+    def test_none(self):
+        self.assertIsNone(refresh_target(b'<html><meta charset="utf-8"></html>', self.base))
+        self.assertIsNone(refresh_target(b'<meta http-equiv="refresh" content="0;url=javascript:alert(1)">',
+                                         self.base))
+
+
+class GroupByExtensionTest(unittest.TestCase):
+    def test_groups(self):
+        files = [{'url': 'https://telegra.ph/file/a.jpg', 'type': 'image/jpeg', 'size': 10},
+                 {'url': 'https://telegra.ph/file/b.JPG', 'type': 'image/jpeg', 'size': None},
+                 {'url': 'https://telegra.ph/file/c', 'type': None, 'size': 5}]
+        self.assertEqual(group_by_extension(files), [
+            {'extension': '.jpg', 'types': ['image/jpeg'], 'files': 2, 'bytes': 10, 'unknown_size': 1},
+            {'extension': '(none)', 'types': [], 'files': 1, 'bytes': 5, 'unknown_size': 0}])
+
+
+if __name__ == '__main__':
+    unittest.main()
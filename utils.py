@@ -1,12 +1,64 @@
+import os
+import re
+import html
+import asyncio
+import math
+import time
+import netrc
+import shutil
+import contextlib
+import hashlib
+import ipaddress
 import pathlib
 import argparse
+import mimetypes
+import tempfile
+import subprocess
+from urllib.parse import urljoin, urlsplit, parse_qs, quote
+from errors import InvalidURLError
 
+try:
+    from PIL import Image
+except ImportError:
+    Image = None
 
-def convert_bytes(num):
-    for x in ['bytes', 'KB', 'MB', 'GB', 'TB']:
-        if num < 1024.0:
-            return f'{num:.2f} {x}'
-        num /= 1024.0
+
+ASCII_PUNCTUATION = str.maketrans({'—': '-', '–': '-', '‘': "'", '’': "'", '“': '"', '”': '"', '…': '...',
+                                   '·': '-', '→': '->'})
+
+
+class AsciiOutput:
+    def __init__(self, stream):
+        self.stream = stream
+
+    def write(self, text):
+        return self.stream.write(text.translate(ASCII_PUNCTUATION).encode('ascii', 'replace').decode('ascii'))
+
+    def __getattr__(self, name):
+        return getattr(self.stream, name)
+
+
+BYTE_LABELS = {
+    'legacy': (1024.0, ['bytes', 'KB', 'MB', 'GB', 'TB']),
+    'binary': (1024.0, ['bytes', 'KiB', 'MiB', 'GiB', 'TiB']),
+    'decimal': (1000.0, ['bytes', 'kB', 'MB', 'GB', 'TB'])
+}
+
+
+def convert_bytes(num, units='legacy', precision=2):
+    base, labels = BYTE_LABELS[units]
+    for x in labels:
+        if num < base or x == labels[-1]:
+            return f'{num:.{precision}f} {x}'
+        num /= base
+
+
+def sha256sum(path):
+    digest = hashlib.sha256()
+    with open(path, 'rb') as file:
+        for chunk in iter(lambda: file.read(1024 * 1024), b''):
+            digest.update(chunk)
+    return digest.hexdigest()
 
 
 def getsize(path):
@@ -24,13 +76,895 @@ def getsize(path):
     return {'raw': raw_size, 'formatted': formatted_size}
 
 
+def node_parts(node):
+    tag, attrs, children = node.get('tag'), node.get('attrs'), node.get('children')
+    return (tag if isinstance(tag, str) else None, attrs if isinstance(attrs, dict) else {},
+            children if isinstance(children, list) else [])
+
+
+def node_text(node):
+    parts, stack = [], [node]
+    while stack:
+        node = stack.pop()
+        if isinstance(node, str):
+            parts.append(node)
+        elif isinstance(node, dict):
+            stack.extend(reversed(node_parts(node)[2]))
+    return ''.join(parts)
+
+
+MEDIA_SOURCES = {'img': ('src', 'data-src', 'data-original', 'data-lazy-src'), 'video': ('src',), 'embed': ('src',),
+                 'object': ('data',)}
+PLACEHOLDER = re.compile(r'(blank|pixel|spacer|1x1|transparent|placeholder|lazy|loading)\.(gif|png|svg)', re.I)
+
+
+def placeholder(src):
+    return src.startswith('data:') or bool(PLACEHOLDER.fullmatch(media_name(src)))
+
+
+def media_source(attrs, names):
+    values = [attrs[name] for name in names if isinstance(attrs.get(name), str) and attrs[name].strip()]
+    return next((value for value in values if not placeholder(value)),
+                next((value for value in values if not value.startswith('data:')), None))
+
+
+def limit_depth(content, max_depth):
+    pruned = 0
+    stack = [(node, 1) for node in content]
+    while stack:
+        node, depth = stack.pop()
+        if not isinstance(node, dict) or not node_parts(node)[2]:
+            continue
+        if depth >= max_depth:
+            node['children'] = []
+            pruned += 1
+        else:
+            stack.extend((child, depth + 1) for child in node['children'])
+    return pruned
+
+
+def extract_media(content, sources=MEDIA_SOURCES):
+    media, embeds, problems = [], [], []
+    stack = [(node, None) for node in reversed(content)]
+    while stack:
+        node, caption = stack.pop()
+        if not isinstance(node, dict):
+            problems.append(f"unexpected {type(node).__name__} node") if not isinstance(node, str) else None
+            continue
+
+        tag = node.get('tag') if isinstance(node.get('tag'), str) else None
+        attrs, children = node.get('attrs') or {}, node.get('children') or []
+        if not isinstance(attrs, dict) or not isinstance(children, list):
+            problems.append(f"<{tag}> has malformed attrs or children")
+            attrs, children = attrs if isinstance(attrs, dict) else {}, children if isinstance(children, list) else []
+        if tag == 'figure':
+            caption = next((node_text(child) for child in children
+                            if isinstance(child, dict) and child.get('tag') == 'figcaption'), None)
+
+        src = media_source(attrs, sources.get(tag, ('src',)))
+        if (tag in sources or tag == 'iframe') and not src:
+            problems.append(f"<{tag}> without {' or '.join(sources.get(tag, ('src',)))}")
+        if tag in sources and src:
+            media.append({'src': src, 'tag': tag, 'alt': attrs.get('alt'), 'caption': caption})
+        if tag == 'iframe' and src:
+            embeds.append(embed_url(src))
+
+        stack.extend((child, caption) for child in reversed(children))
+    return media, embeds, problems
+
+
+def render_tree(nodes, depth=0, sources=MEDIA_SOURCES):
+    lines = []
+    stack = [(node, depth) for node in reversed(nodes)]
+    while stack:
+        node, depth = stack.pop()
+        if isinstance(node, str):
+            text = ' '.join(node.split())
+            lines.append(f'{"  " * depth}"{text[:60] + "..." if len(text) > 60 else text}"')
+            continue
+        if not isinstance(node, dict):
+            lines.append(f"{'  ' * depth}[unexpected {type(node).__name__} node]")
+            continue
+
+        tag, attrs, children = node_parts(node)
+        src = media_source(attrs, sources.get(tag, ('src',)))
+        mark = ''
+        if tag in sources and src:
+            mark = ' [media]'
+        elif tag == 'iframe' and src:
+            mark = ' [embed]'
+        lines.append(f"{'  ' * depth}<{tag}>{' ' + src if src else ''}{mark}")
+        stack.extend((child, depth + 1) for child in reversed(children))
+    return lines
+
+
+def render_index(title, author, source, entries):
+    cells = []
+    for path, tag, caption in entries:
+        href = html.escape(quote(path))
+        preview = f'<a href="{href}">{html.escape(path)}</a>'
+        if tag == 'video':
+            preview = f'<video src="{href}" controls preload="metadata"></video>'
+        elif tag == 'img':
+            preview = f'<a href="{href}"><img src="{href}" loading="lazy" alt="{html.escape(caption or "")}"></a>'
+        caption = f'<figcaption>{html.escape(caption)}</figcaption>' if caption else ''
+        cells.append(f'<figure>{preview}{caption}</figure>')
+
+    byline = ' &middot; '.join(filter(None, [
+        html.escape(author or ''),
+        f'<a href="{html.escape(source)}">{html.escape(source)}</a>' if source else ''
+    ]))
+
+    return f'''<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{html.escape(title)}</title>
+<style>
+body {{ font-family: sans-serif; margin: 2em; }}
+main {{ display: grid; grid-template-columns: repeat(auto-fill, minmax(240px, 1fr)); gap: 1em; }}
+figure {{ margin: 0; }}
+img, video {{ width: 100%; border-radius: 4px; }}
+figcaption {{ font-size: .9em; color: #666; }}
+@media (prefers-color-scheme: dark) {{
+  body {{ background: #111; color: #ddd; }}
+  a {{ color: #8ab4f8; }}
+  figcaption {{ color: #999; }}
+}}
+</style>
+</head>
+<body>
+<h1>{html.escape(title)}</h1>
+<p>{byline}</p>
+<main>
+{chr(10).join(cells)}
+</main>
+</body>
+</html>
+'''
+
+
+GALLERY_TAGS = {'image': 'img', 'video': 'video'}
+
+
+def gallery_entries(folder):
+    entries = []
+    for file in sorted(folder.glob('**/*')):
+        tag = GALLERY_TAGS.get((mimetypes.guess_type(file)[0] or '').split('/')[0])
+        if tag and file.is_file() and 'thumbnails' not in file.relative_to(folder).parts:
+            entries.append((file.relative_to(folder).as_posix(), tag, None))
+    return entries
+
+
+MIRROR_TAGS = ('a', 'aside', 'b', 'blockquote', 'br', 'code', 'em', 'embed', 'figcaption', 'figure', 'h3', 'h4', 'hr',
+               'i', 'iframe', 'img', 'li', 'object', 'ol', 'p', 'pre', 's', 'strong', 'u', 'ul', 'video')
+MIRROR_ATTRIBUTES = ('href', 'src', 'data', 'alt')
+
+
+def mirror_link(value, links):
+    if value.startswith('#'):
+        return value
+    url = media_url(value)
+    if url in links:
+        return links[url]
+    return url if urlsplit(url).scheme in ('http', 'https') else None
+
+
+def render_nodes(nodes, links, sources=MEDIA_SOURCES):
+    parts = []
+    stack = [(node, False) for node in reversed(nodes)]
+    while stack:
+        node, closing = stack.pop()
+        if closing:
+            parts.append(node)
+            continue
+        if isinstance(node, str):
+            parts.append(html.escape(node))
+            continue
+        if not isinstance(node, dict):
+            continue
+
+        tag, node_attrs, children = node_parts(node)
+        if tag not in MIRROR_TAGS:
+            stack.extend((child, False) for child in reversed(children))
+            continue
+        attrs, names = '', ()
+        src = media_source(node_attrs, sources[tag]) if tag in sources else None
+        if src and media_url(src) in links:
+            names = sources[tag]
+            attrs = f' {"data" if tag == "object" else "src"}="{html.escape(links[media_url(src)])}"'
+        for name, value in node_attrs.items():
+            if not isinstance(value, str) or name not in MIRROR_ATTRIBUTES or name in names \
+                    or (names and name in ('src', 'data')):
+                continue
+            if name != 'alt' and (value := mirror_link(value, links)) is None:
+                continue
+            attrs += f' {name}="{html.escape(value)}"'
+        if tag == 'video':
+            attrs += ' controls'
+
+        parts.append(f'<{tag}{attrs}>')
+        if tag not in ('br', 'hr', 'img', 'embed'):
+            stack.append((f'</{tag}>', True))
+            stack.extend((child, False) for child in reversed(children))
+    return ''.join(parts)
+
+
+def render_mirror(title, author, source, content, links, sources=MEDIA_SOURCES):
+    byline = ' &middot; '.join(filter(None, [html.escape(author or ''),
+                                             f'<a href="{html.escape(source)}">{html.escape(source)}</a>']))
+    return f'''<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{html.escape(title)}</title>
+<style>
+body {{ font-family: serif; max-width: 732px; margin: 2em auto; padding: 0 1em; line-height: 1.6; }}
+img, video, iframe {{ max-width: 100%; }}
+figure {{ margin: 1em 0; }}
+figcaption {{ font-size: .9em; color: #666; text-align: center; }}
+</style>
+</head>
+<body>
+<h1>{html.escape(title)}</h1>
+<p>{byline}</p>
+<article>
+{render_nodes(content, links, sources)}
+</article>
+</body>
+</html>
+'''
+
+
+def parse_selection(text, count):
+    if text.strip().lower() in ('', 'all'):
+        return list(range(count))
+
+    selection = set()
+    for part in text.replace(' ', '').split(','):
+        first, _, last = part.partition('-')
+        if not first.isdigit() or not (last or first).isdigit():
+            raise ValueError(f"{part!r} is not a number or a range like 3-5")
+        if not 1 <= int(first) <= int(last or first) <= count:
+            raise ValueError(f"{part!r} is outside 1-{count}")
+        selection.update(range(int(first) - 1, int(last or first)))
+    return sorted(selection)
+
+
+TELEGRAPH_HOSTS = ('telegra.ph', 'www.telegra.ph', 'graph.org')
+
+
+def page_path(link):
+    url = link if '://' in link else f"https://{link}" if '/' in link else f"https://telegra.ph/{link}"
+    parts = urlsplit(url)
+    path = parts.path.strip('/')
+    if parts.scheme not in ('http', 'https') or parts.hostname not in TELEGRAPH_HOSTS or not path or '/' in path:
+        raise InvalidURLError(f"{link} is not a link to a telegra.ph page")
+    return path
+
+
+def media_url(src):
+    return urljoin('https://telegra.ph/', src)
+
+
+def media_name(url):
+    return pathlib.PurePosixPath(urlsplit(url).path).name
+
+
+MEDIA_CATEGORIES = {'image': 'images', 'video': 'videos', 'audio': 'audio'}
+
+
+def media_category(mime):
+    return MEDIA_CATEGORIES.get((mime or '').split('/')[0], 'other')
+
+
+def file_names(urls, prefix=True, alts=None, cover=None):
+    names, taken, copies = [None] * len(urls), set(), {}
+    for number in sorted(range(len(urls)), key=lambda number: number != cover):
+        base = media_name(urls[number])
+        alt = alts[number] if alts else None
+        if number == cover:
+            base = f"cover{pathlib.PurePosixPath(base).suffix or '.jpg'}"
+        elif isinstance(alt, str) and (alt := sanitize_filename(' '.join(alt.split()))):
+            base = f"{alt}{pathlib.PurePosixPath(base).suffix}"
+        base = sanitize_filename(base) or 'file'
+        name = pathlib.PurePath(f"{number}_{base}" if prefix and number != cover else base)
+        candidate, copy = name.name, copies.get(name.name, 0)
+        while candidate in taken:
+            copy += 1
+            candidate = f"{name.stem}_{copy}{name.suffix}"
+        names[number], copies[name.name] = candidate, copy
+        taken.add(candidate)
+    return names
+
+
+def group_by_extension(files):
+    groups = {}
+    for file in files:
+        extension = pathlib.PurePosixPath(media_name(file['url'])).suffix.lower() or '(none)'
+        group = groups.setdefault(extension, {'extension': extension, 'types': [], 'files': 0, 'bytes': 0,
+                                              'unknown_size': 0})
+        group['files'] += 1
+        if file['type'] and file['type'] not in group['types']:
+            group['types'].append(file['type'])
+        if file['size'] is None:
+            group['unknown_size'] += 1
+        else:
+            group['bytes'] += file['size']
+    return sorted(groups.values(), key=lambda group: (-group['files'], group['extension']))
+
+
+def convert_image(path, extension):
+    target = path.with_suffix(f".{extension}")
+    with Image.open(path) as image:
+        if extension in ('jpg', 'jpeg') and image.mode not in ('RGB', 'L'):
+            image = image.convert('RGB')
+        image.save(target)
+    return target
+
+
+FTYP_BRANDS = {
+    **dict.fromkeys((b'isom', b'iso2', b'iso4', b'iso5', b'iso6', b'mp41', b'mp42', b'avc1', b'dash', b'M4V ',
+                     b'MSNV'), ('video/mp4', '.mp4')),
+    b'qt  ': ('video/quicktime', '.mov'),
+    **dict.fromkeys((b'3gp4', b'3gp5', b'3gp6', b'3g2a'), ('video/3gpp', '.3gp')),
+    **dict.fromkeys((b'M4A ', b'M4B '), ('audio/mp4', '.m4a')),
+    **dict.fromkeys((b'avif', b'avis'), ('image/avif', '.avif')),
+    **dict.fromkeys((b'heic', b'heix', b'heim', b'heis'), ('image/heic', '.heic')),
+    **dict.fromkeys((b'mif1', b'msf1'), ('image/heif', '.heif')),
+}
+
+
+def sniff_type(body):
+    if body.startswith(b'\xff\xd8\xff'):
+        return 'image/jpeg', '.jpg'
+    if body.startswith(b'\x89PNG\r\n\x1a\n'):
+        return 'image/png', '.png'
+    if body.startswith((b'GIF87a', b'GIF89a')):
+        return 'image/gif', '.gif'
+    if body.startswith(b'RIFF') and body[8:12] == b'WEBP':
+        return 'image/webp', '.webp'
+    if body.startswith(b'\x1aE\xdf\xa3'):
+        return 'video/webm', '.webm'
+    if body.startswith(b'%PDF-'):
+        return 'application/pdf', '.pdf'
+    if body[4:8] == b'ftyp':
+        return FTYP_BRANDS.get(body[8:12])
+    return None
+
+
+def sniffed_name(filename, extension, taken):
+    path = pathlib.PurePath(filename)
+    candidate, number = f"{path.stem}{extension}", 0
+    while candidate in taken:
+        number += 1
+        candidate = f"{path.stem}_{number}{extension}"
+    return candidate
+
+
+def strip_jpeg_metadata(body):
+    stripped, offset = [body[:2]], 2
+    while offset + 4 <= len(body) and body[offset] == 0xFF:
+        marker = body[offset + 1]
+        if marker == 0xDA:
+            break
+        end = offset + 2 + int.from_bytes(body[offset + 2:offset + 4], 'big')
+        # APP1 holds Exif/XMP, APP13 holds IPTC and COM is a free-form comment
+        if marker not in (0xE1, 0xED, 0xFE):
+            stripped.append(body[offset:end])
+        offset = end
+    stripped.append(body[offset:])
+    return b''.join(stripped)
+
+
+def strip_png_metadata(body):
+    stripped, offset = [body[:8]], 8
+    while offset + 8 <= len(body):
+        end = offset + 12 + int.from_bytes(body[offset:offset + 4], 'big')
+        if body[offset + 4:offset + 8] not in (b'eXIf', b'tEXt', b'iTXt', b'zTXt', b'tIME'):
+            stripped.append(body[offset:end])
+        offset = end
+    stripped.append(body[offset:])
+    return b''.join(stripped)
+
+
+def strip_metadata(body):
+    if body.startswith(b'\xff\xd8'):
+        return strip_jpeg_metadata(body)
+    if body.startswith(b'\x89PNG\r\n\x1a\n'):
+        return strip_png_metadata(body)
+    return body
+
+
+def thumbnail(path, size):
+    if (mimetypes.guess_type(path)[0] or '').startswith('video/'):
+        if shutil.which('ffmpeg') is None:
+            return None
+        with tempfile.TemporaryDirectory() as directory:
+            frame = pathlib.Path(directory).joinpath('frame.jpg')
+            subprocess.run(['ffmpeg', '-loglevel', 'error', '-i', str(path), '-frames:v', '1', str(frame)])
+            return thumbnail(frame, size) if frame.exists() else None
+    try:
+        with Image.open(path) as image:
+            image.thumbnail(size)
+            return image.convert('RGB')
+    except OSError:
+        return None
+
+
+def contact_sheet(images, size):
+    columns = math.ceil(math.sqrt(len(images)))
+    rows = math.ceil(len(images) / columns)
+    sheet = Image.new('RGB', (columns * size[0], rows * size[1]), 'white')
+    for index, image in enumerate(images):
+        row, column = divmod(index, columns)
+        sheet.paste(image, (column * size[0] + (size[0] - image.width) // 2,
+                            row * size[1] + (size[1] - image.height) // 2))
+    return sheet
+
+
+def looks_like_html(content_type, body):
+    return content_type == 'text/html' or body.lstrip()[:14].lower().startswith((b'<!doctype html', b'<html'))
+
+
+META_TAG = re.compile(r'<meta\b[^>]*>', re.I)
+META_ATTRIBUTE = re.compile(r'''([\w-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))''')
+REFRESH_URL = re.compile(r'''^\s*\d*(?:\.\d+)?\s*[;,]\s*url\s*=\s*(['"]?)(.+?)\1\s*$''', re.I)
+SCRIPT_REDIRECT = re.compile(r'''(?:window\.|document\.)?location(?:\.href)?\s*=\s*["']([^"']+)["']'''
+                             r'''|location\.(?:replace|assign)\(\s*["']([^"']+)["']\s*\)''')
+
+
+def refresh_target(body, base):
+    text = body.decode('utf-8', errors='replace')
+    target = None
+    for tag in META_TAG.findall(text):
+        attributes = {name.lower(): next(filter(None, values), '') for name, *values in META_ATTRIBUTE.findall(tag)}
+        if attributes.get('http-equiv', '').lower() == 'refresh' and \
+                (match := REFRESH_URL.match(html.unescape(attributes.get('content', '')))):
+            target = urljoin(base, match.group(2).strip())
+            break
+    if target is None and (match := SCRIPT_REDIRECT.search(text)):
+        target = urljoin(base, html.unescape(match.group(1) or match.group(2)))
+    return target if target and urlsplit(target).scheme in ('http', 'https') else None
+
+
+def embed_url(src):
+    query = parse_qs(urlsplit(src).query)
+    return query['url'][0] if 'url' in query else src
+
+
+def sanitize_filename(name):
+    return re.sub(r'[<>:"/\\|?*\x00-\x1f]', '_', name).strip(' .')[:200]
+
+
+WINDOWS_MAX_PATH = 260
+
+
+def long_path(path):
+    path = os.path.abspath(path)
+    if os.name != 'nt' or len(path) < WINDOWS_MAX_PATH or path.startswith('\\\\?\\'):
+        return pathlib.Path(path)
+    if path.startswith('\\\\'):
+        return pathlib.Path(f"\\\\?\\UNC\\{path[2:]}")
+    return pathlib.Path(f"\\\\?\\{path}")
+
+
+def stage_folder(folder, temp_dir=None):
+    if temp_dir:
+        temp_dir.mkdir(parents=True, exist_ok=True)
+        return pathlib.Path(tempfile.mkdtemp(prefix=f"{folder.name}.staging-", dir=temp_dir))
+    staging = folder.joinpath(f".tele-dl-staging-{os.getpid()}")
+    shutil.rmtree(staging, ignore_errors=True)
+    staging.mkdir(parents=True)
+    return staging
+
+
+def commit_folder(staging, folder):
+    for path in sorted(staging.rglob('*')):
+        if path.is_dir() and not path.is_symlink():
+            continue
+        destination = folder.joinpath(path.relative_to(staging))
+        destination.parent.mkdir(parents=True, exist_ok=True)
+        if destination.is_symlink() or destination.is_file():
+            destination.unlink()
+        shutil.move(str(path), str(destination))
+    shutil.rmtree(staging)
+
+
+def unique_path(path, *folders):
+    candidate, number = path, 0
+    while candidate.exists() or any(folder.joinpath(candidate.name).exists() for folder in folders if folder):
+        number += 1
+        candidate = path.with_name(f"{path.stem}_{number}{path.suffix}")
+    return candidate
+
+
+def expand_folder(folder, title):
+    folder = os.path.expandvars(os.path.expanduser(str(folder)))
+    return pathlib.Path(folder.replace('{title}', title))
+
+
+def retry_delay(attempt, base, maximum, strategy):
+    delay = base * attempt if strategy == 'linear' else base * 2 ** (attempt - 1)
+    return min(delay, maximum)
+
+
+class Retry:
+    def __init__(self, retries, base, maximum, strategy, spend=None, sleep=asyncio.sleep):
+        self.retries, self.base, self.maximum, self.strategy = retries, base, maximum, strategy
+        self.spend, self.sleep = spend, sleep
+        self.exhausted = False
+
+    async def __aiter__(self):
+        for attempt in range(self.retries + 1):
+            if attempt:
+                if self.spend and not self.spend():
+                    self.exhausted = True
+                    return
+                await self.sleep(retry_delay(attempt, self.base, self.maximum, self.strategy))
+            yield attempt
+
+
+class Breaker:
+    def __init__(self, threshold, cooldown, clock=time.monotonic):
+        self.threshold, self.cooldown, self.clock = threshold, cooldown, clock
+        self.hosts = {}
+
+    def tripped(self, host):
+        failures, opened_at = self.hosts.get(host, (0, 0))
+        return 0 < self.threshold <= failures and self.clock() - opened_at < self.cooldown
+
+    def record(self, host, succeeded):
+        if succeeded:
+            self.hosts.pop(host, None)
+        else:
+            self.hosts[host] = (self.hosts.get(host, (0, 0))[0] + 1, self.clock())
+
+
+class ByteBudget:
+    def __init__(self, limit):
+        self.limit, self.used = limit, 0
+        self.condition = asyncio.Condition()
+
+    @contextlib.asynccontextmanager
+    async def reserve(self, size):
+        size = min(size, self.limit)
+        async with self.condition:
+            await self.condition.wait_for(lambda: self.used + size <= self.limit)
+            self.used += size
+        try:
+            yield
+        finally:
+            async with self.condition:
+                self.used -= size
+                self.condition.notify_all()
+
+
+def non_negative_int(value):
+    if not value.isdigit():
+        raise argparse.ArgumentTypeError(f"expected a non-negative whole number, got {value!r}")
+    return int(value)
+
+
+def writable_fd(value):
+    fd = non_negative_int(value)
+    try:
+        os.write(fd, b'')
+    except OSError as error:
+        raise argparse.ArgumentTypeError(f"file descriptor {fd} is not open for writing: {error.strerror}")
+    return fd
+
+
+def load_netrc(path=None):
+    if path is None:
+        path = pathlib.Path.home().joinpath('.netrc')
+        if not path.exists():
+            return None
+    return netrc.netrc(str(path))
+
+
+def dimensions(value):
+    width, _, height = value.lower().partition('x')
+    if not (width.isdigit() and height.isdigit() and int(width) and int(height)):
+        raise argparse.ArgumentTypeError(f"expected WIDTHxHEIGHT, got {value!r}")
+    return int(width), int(height)
+
+
+def host_limits(value):
+    limits = []
+    for entry in filter(None, value.split(',')):
+        pattern, _, limit = entry.partition('=')
+        if not pattern or not limit.isdigit() or int(limit) < 1:
+            raise argparse.ArgumentTypeError(f"expected HOST=N[,HOST=N...], got {entry!r}")
+        limits.append((pattern.strip().lower(), int(limit)))
+    return limits
+
+
+def host_address(value):
+    host, _, address = value.partition(':')
+    try:
+        address = str(ipaddress.ip_address(address.strip().strip('[]')))
+    except ValueError:
+        address = None
+    if not host.strip() or not address:
+        raise argparse.ArgumentTypeError(f"expected HOST:IP such as telegra.ph:1.2.3.4, got {value!r}")
+    return host.strip().lower(), address
+
+
+def source_attributes(value):
+    tag, _, names = value.partition('=')
+    names = tuple(filter(None, (name.strip() for name in names.split(','))))
+    if not tag.strip() or not names:
+        raise argparse.ArgumentTypeError(f"expected TAG=ATTR[,ATTR...] such as img=data-src,src, got {value!r}")
+    return tag.strip().lower(), names
+
+
+def conversion(value):
+    source, _, target = value.lower().partition('=')
+    source, target = source.strip().lstrip('.'), target.strip().lstrip('.')
+    if not source or not target or source == target:
+        raise argparse.ArgumentTypeError(f"expected FROM=TO extensions such as webp=png, got {value!r}")
+    if Image is not None and Image.registered_extensions().get(f'.{target}') not in Image.SAVE:
+        raise argparse.ArgumentTypeError(f"Pillow cannot save {target!r} images")
+    return source, target
+
+
+BYTE_UNITS = {'': 1, 'B': 1}
+for power, prefix in enumerate('KMGT', 1):
+    BYTE_UNITS.update({prefix: 1024 ** power, f'{prefix}IB': 1024 ** power, f'{prefix}B': 1024 ** power})
+
+
+def parse_bytes(value):
+    match = re.fullmatch(r'(\d+(?:\.\d+)?|\.\d+)\s*([A-Za-z]*)', value.strip())
+    if not match:
+        raise ValueError(f"expected a size such as 500K, 100MB or 1.5GiB, got {value!r}")
+    if match.group(2).upper() not in BYTE_UNITS:
+        raise ValueError(f"unknown size unit {match.group(2)!r} in {value!r}, use B, K, KB, KiB, M, MB, MiB, G, ...")
+    return int(float(match.group(1)) * BYTE_UNITS[match.group(2).upper()])
+
+
+class SizeLimit(int):
+    def __new__(cls, text):
+        limit = super().__new__(cls, parse_bytes(text))
+        limit.text = f"{text.strip()} bytes" if re.fullmatch(r'[\d.]+', text.strip()) else text.strip()
+        return limit
+
+
+def size_limits(value):
+    limits = {}
+    for entry in filter(None, value.split(',')):
+        extension, _, size = entry.partition('=')
+        try:
+            limits[f".{extension.strip().lstrip('.').lower()}"] = SizeLimit(size)
+        except ValueError as error:
+            raise argparse.ArgumentTypeError(str(error))
+    return limits
+
+
+def byte_size(value):
+    try:
+        return parse_bytes(value)
+    except ValueError as error:
+        raise argparse.ArgumentTypeError(str(error))
+
+
+def api_param(value):
+    key, separator, param = value.partition('=')
+    if not key or not separator:
+        raise argparse.ArgumentTypeError(f"expected KEY=VALUE, got {value!r}")
+    return key.strip(), param
+
+
+# ujson refuses JSON nested more than 1024 levels deep, and every node takes two: itself and its children list
+MAX_DEPTH = 500
+
+
+def depth_limit(value):
+    number = positive_int(value)
+    if number > MAX_DEPTH:
+        raise argparse.ArgumentTypeError(f"must be at most {MAX_DEPTH}, deeper pages cannot be decoded, got {value}")
+    return number
+
+
+def positive_int(value):
+    if not value.lstrip('-').isdigit():
+        raise argparse.ArgumentTypeError(f"expected a whole number, got {value!r}")
+    number = int(value)
+    if number < 1:
+        raise argparse.ArgumentTypeError(f"must be at least 1, got {value}")
+    return number
+
+
+def port(value):
+    number = positive_int(value)
+    if number > 65535:
+        raise argparse.ArgumentTypeError(f"ports go up to 65535, got {value}")
+    return number
+
+
+def duration(value):
+    value = value.strip().lower()
+    if re.fullmatch(r'\d+(\.\d+)?', value):
+        return float(value)
+    if not re.fullmatch(r'(\d+(\.\d+)?(ms|s|m|h))+', value):
+        raise argparse.ArgumentTypeError(f"expected seconds or a duration like 90s, 1m30s or 500ms, got {value!r}")
+    units = {'ms': 0.001, 's': 1, 'm': 60, 'h': 3600}
+    return sum(float(number) * units[unit] for number, _, unit in re.findall(r'(\d+(\.\d+)?)(ms|s|m|h)', value))
+
+
 def arguments():
     parser = argparse.ArgumentParser()
     parser.add_argument('--link', '-L', help='Enter the full link to the page. Example: '
-                                             '"https://telegra.ph/What-Was-TON-And-Why-It-Is-Over-05-12"', type=str,
-                        required=True)
-    parser.add_argument('--folder', '-F', help='Specify the folder where to extract images', type=pathlib.Path,
+                                             '"https://telegra.ph/What-Was-TON-And-Why-It-Is-Over-05-12"', type=str)
+    parser.add_argument('--stdin', help='Read page links from standard input, one per line. Same as "--link -"',
+                        action="store_true")
+    parser.add_argument('--folder', '-F', help='Specify the folder where to extract images. '
+                                               'Expands "~", environment variables and {title}. '
+                                               '"@tmp" for a temporary folder, "-" for --stdout', type=pathlib.Path,
                         default=pathlib.Path().absolute())
+    parser.add_argument('--workers', '-W', help='Number of simultaneous downloads', type=positive_int, default=50)
+    parser.add_argument('--host-workers', help='Per-host download limits, e.g. "telegra.ph=20,*.cdn.com=2"',
+                        type=host_limits, default=[], metavar='HOST=N,...')
+    parser.add_argument('--host-rate', help='Requests per second to a single host (0 for no limit)',
+                        type=non_negative_int)
+    parser.add_argument('--max-conns-per-host', help='Number of simultaneous connections to a single host',
+                        type=positive_int, default=10)
+    parser.add_argument('--keepalive-timeout', help='Seconds to keep an idle connection open for reuse',
+                        type=duration, default=30)
+    parser.add_argument('--dns-cache-ttl', help='Seconds to cache DNS lookups', type=duration, default=300)
+    parser.add_argument('--resolve', help='Connect to this address for the host, e.g. "telegra.ph:1.2.3.4". '
+                        'Repeatable', type=host_address, action='append', metavar='HOST:IP')
+    parser.add_argument('--ramp-up', help='Spread the start of the first downloads over this many seconds',
+                        type=duration, default=0)
+    parser.add_argument('--small-file-threshold', help='Download files at least this large, e.g. "10MB", in a '
+                        'separate pool of --large-workers', type=byte_size, metavar='SIZE')
+    parser.add_argument('--large-workers', help='Number of simultaneous downloads of large files', type=positive_int,
+                        default=4)
+    parser.add_argument('--max-inflight-bytes', help='Start no download that would take the total size of the '
+                        'files being downloaded over this, e.g. "500MB"', type=byte_size, metavar='SIZE')
+    parser.add_argument('--download-order', help='Download the media in page order or from the end of the page',
+                        choices=['document', 'reverse'], default='document')
+    parser.add_argument('--shuffle', help='Download the media in random order', action="store_true")
+    parser.add_argument('--seed', help='Seed for --shuffle, to repeat the same order', type=int)
+    parser.add_argument('--timeout', '-T', help='Abort the whole run, including the page fetch, after N seconds',
+                        type=duration, default=0)
+    parser.add_argument('--retries', '-R', help='Retry each failed download this many times', type=non_negative_int,
+                        default=0)
+    parser.add_argument('--page-retries', help='Retry fetching a page this many times after network errors and 5xx',
+                        type=non_negative_int, default=3)
+    parser.add_argument('--max-retries-total', help='Stop retrying any download once this many retries were made',
+                        type=non_negative_int)
+    parser.add_argument('--retry-base-delay', help='Seconds to wait before the first retry', type=duration,
+                        default=1)
+    parser.add_argument('--retry-max-delay', help='Upper bound for the wait between retries', type=duration,
+                        default=30)
+    parser.add_argument('--retry-strategy', help='How the wait grows between retries',
+                        choices=['linear', 'exponential'], default='exponential')
+    parser.add_argument('--quiet-errors', help='Do not report 404 responses as failures', action="store_true")
+    parser.add_argument('--breaker-threshold', help='Stop contacting a host after this many consecutive failures',
+                        type=non_negative_int, default=0)
+    parser.add_argument('--breaker-cooldown', help='Seconds before a tripped host is tried again',
+                        type=duration, default=30)
+    parser.add_argument('--netrc', help='Read download credentials from this file instead of ~/.netrc',
+                        type=pathlib.Path)
+    parser.add_argument('--no-netrc', help='Do not send credentials from a netrc file', action="store_true")
+    parser.add_argument('--organize-by-type', help='Sort files into images, videos, audio and other subfolders',
+                        action="store_true")
+    parser.add_argument('--no-index-prefix', help='Save files under their original names, without the number prefix',
+                        action="store_true")
+    parser.add_argument('--rename-from-alt', help='Name files after the alt text of their image where it is set',
+                        action="store_true")
+    parser.add_argument('--dedup-link', help='Replace identical files with hard links, symlinks, or delete them',
+                        choices=['hard', 'symlink', 'delete'])
+    parser.add_argument('--only-new', help='Skip files whose content is already saved anywhere under the folder',
+                        action="store_true")
+    parser.add_argument('--no-skip', help='Download every file again, next to existing copies instead of over them',
+                        action="store_true")
+    parser.add_argument('--max-size-by-ext', help='Skip files over a size for their extension, e.g. ".mp4=100MB"',
+                        type=size_limits, default={}, metavar='.EXT=SIZE,...')
+    parser.add_argument('--atomic-run', help='Stage new files, move them into the folder only if nothing failed',
+                        action="store_true")
+    parser.add_argument('--temp-dir', help='Stage --atomic-run downloads in this folder instead of inside --folder',
+                        type=lambda path: pathlib.Path(os.path.expanduser(path)), metavar='DIR')
+    parser.add_argument('--stdout', help='Write the only file of the page to standard output, logging to stderr. '
+                        'Same as --folder -', action="store_true")
+    parser.add_argument('--verify-existing', help='Download existing files again if their size differs from the server',
+                        action="store_true")
+    parser.add_argument('--strict-content-type', help='Treat HTML pages served in place of media as failures',
+                        action="store_true")
+    parser.add_argument('--strip-metadata', help='Remove Exif, XMP and text metadata from JPEG and PNG images',
+                        action="store_true")
+    parser.add_argument('--thumbnails', help='Write thumbnails of the saved media into a thumbnails subfolder',
+                        type=dimensions, nargs='?', const=(256, 256), metavar='WxH')
+    parser.add_argument('--contact-sheet', help='Combine thumbnails of the saved media into one image',
+                        type=pathlib.Path, metavar='FILE')
+    parser.add_argument('--html-index', help='Write an index.html gallery of the saved media into the folder',
+                        action="store_true")
+    parser.add_argument('--mirror', help='Save the page as HTML that points at the downloaded files', type=pathlib.Path,
+                        metavar='FILE')
+    parser.add_argument('--archive', help='Also pack the folder into an archive next to it',
+                        choices=['zip', 'tar', 'tar.gz'])
+    parser.add_argument('--convert', help='Convert downloaded images, e.g. webp=png. Repeatable. Needs Pillow',
+                        type=conversion, action="append", metavar='FROM=TO')
+    parser.add_argument('--keep-original', help='Keep the original next to the converted file', action="store_true")
+    parser.add_argument('--follow-meta-refresh', help='Follow meta refresh and script redirects of small HTML '
+                        'pages served in place of media', action="store_true")
+    parser.add_argument('--fix-extensions', help='Rename files whose content does not match their extension',
+                        action="store_true")
+    parser.add_argument('--referer-auto', help='Send the page link as Referer, or the host root to other hosts',
+                        action="store_true")
+    parser.add_argument('--basic-auth', help='Send these credentials to --auth-host', metavar='USER:PASS')
+    parser.add_argument('--bearer-token', help='Send this bearer token to --auth-host', metavar='TOKEN')
+    parser.add_argument('--auth-host', help='Host allowed to receive --basic-auth or --bearer-token. Repeatable',
+                        action="append")
+    parser.add_argument('--serve', help='Browse the folder over HTTP on this port instead of downloading',
+                        type=port, metavar='PORT')
+    parser.add_argument('--serve-address', help='Address for --serve to listen on, e.g. 0.0.0.0 for every interface',
+                        default='127.0.0.1', metavar='ADDRESS')
+    parser.add_argument('--interactive', '-I', help='List the media and choose which files to download',
+                        action="store_true")
+    parser.add_argument('--api-param', help='Extra getPage query parameter, e.g. return_content=false. Repeatable',
+                        type=api_param, action="append")
+    parser.add_argument('--source-attrs', help='Attributes to read the media URL of a tag from, in order, e.g. '
+                        '"img=data-src,src". Repeatable', type=source_attributes, action='append',
+                        metavar='TAG=ATTR,...')
+    parser.add_argument('--include-cover', help='Also download the cover image of the page as cover.EXT',
+                        action="store_true")
+    parser.add_argument('--parser-mode', help='Fail on media nodes that cannot be read instead of skipping them',
+                        choices=['lenient', 'strict'], default='lenient')
+    parser.add_argument('--max-media', help='Download at most this many files from a page (0 for no limit)',
+                        type=non_negative_int, default=10000)
+    parser.add_argument('--max-depth', help='Ignore page content nested deeper than this many levels',
+                        type=depth_limit, default=MAX_DEPTH)
+    parser.add_argument('--probe', help='Only check that each link is a reachable Telegraph page',
+                        action="store_true")
+    parser.add_argument('--head-check', help='Only check that every media URL is reachable, without downloading',
+                        action="store_true")
+    parser.add_argument('--list-formats', help='Only list the file types of the page with their counts and sizes, '
+                        'without downloading', action="store_true")
+    parser.add_argument('--tree', help='Print the page content tree instead of downloading', action="store_true")
+    parser.add_argument('--fail-if-empty', help='Exit with status 3 if a page has no media', action="store_true")
+    parser.add_argument('--verify', help='Check the folder against a sha256sum manifest instead of downloading',
+                        type=pathlib.Path, metavar='MANIFEST')
+    parser.add_argument('--progress-interval', help='Print a progress line at most this often (0 for never)',
+                        type=duration, default=0)
+    parser.add_argument('--progress-every', help='Print a progress line every N finished files (0 for never)',
+                        type=non_negative_int, default=0, metavar='N')
+    parser.add_argument('--show-files', help='List the downloaded and already saved files in the summary',
+                        action="store_true")
+    parser.add_argument('--units', help='Print sizes in binary (KiB, 1024) or decimal (kB, 1000) units',
+                        choices=['legacy', 'binary', 'decimal'], default='legacy')
+    parser.add_argument('--size-precision', help='Decimal places in printed sizes', type=non_negative_int, default=2)
+    parser.add_argument('--ascii', help='Print plain ASCII without color. On by default when stdout is not UTF-8',
+                        action="store_true")
+    parser.add_argument('--no-color', help='Do not color the output', action="store_true")
+    parser.add_argument('--request-id', help='Run id sent as X-Request-Id with every request. Default: random')
     parser.add_argument('--explicit', '-E', help='Show all messages', action="store_true")
+    parser.add_argument('--subdir-by-title', help='Save media into a subfolder named after the page title',
+                        action="store_true")
+    parser.add_argument('--events', help='Print parse, download and summary events as JSON lines while running',
+                        choices=['json'])
+    parser.add_argument('--json', help='Write a JSON report of the run to the given file', type=pathlib.Path)
+    parser.add_argument('--result-fd', help='Also write the JSON report to this open file descriptor',
+                        type=writable_fd)
+    parser.add_argument('--json-compact', help='Write the JSON report on a single line', action="store_true")
+    parser.add_argument('--failures-file', help='Write each failed download and page as a JSON line to this file',
+                        type=pathlib.Path)
+    parser.add_argument('--history-file', help='Append a JSON line for each saved page to this file',
+                        type=lambda path: pathlib.Path(os.path.expanduser(path)),
+                        default=pathlib.Path.home().joinpath('.tele-dl', 'history.jsonl'))
+    parser.add_argument('--no-history', help='Do not append to the history file', action="store_true")
+    parser.add_argument('--history', help='Print the last N runs from the history file instead of downloading',
+                        type=positive_int, nargs='?', const=10, metavar='N')
+    parser.add_argument('--cache-dir', help='Folder for cached Telegraph API answers',
+                        type=lambda path: pathlib.Path(os.path.expanduser(path)),
+                        default=pathlib.Path.home().joinpath('.tele-dl', 'cache'))
+    parser.add_argument('--cache-ttl', help='Reuse cached Telegraph API answers younger than this, e.g. "10m"',
+                        type=duration, default=0)
+    parser.add_argument('--no-cache', help='Always fetch pages from the API, refreshing the cache',
+                        action="store_true")
+    parser.add_argument('--ytdlp', help='Download embedded YouTube/Vimeo videos with yt-dlp', action="store_true")
 
     return parser
\ No newline at end of file